@@ -0,0 +1,119 @@
+package beater
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	apiKeyFetch       int16 = 1
+	apiKeyListOffsets int16 = 2
+	apiKeyOffsetFetch int16 = 9
+)
+
+// supportedVersions are the newest versions of the requests sarama can encode
+// and decode, fallbackVersions the ones used when the broker versions are
+// unknown.
+var (
+	supportedVersions = map[int16]int16{apiKeyFetch: 4, apiKeyListOffsets: 2, apiKeyOffsetFetch: 5}
+	fallbackVersions  = map[int16]int16{apiKeyFetch: 0, apiKeyListOffsets: 0, apiKeyOffsetFetch: 1}
+)
+
+// requiredKafkaVersions are the kafka_version every request version needs,
+// by index. sarama refuses to send requests newer than its configured version.
+var requiredKafkaVersions = map[int16][]sarama.KafkaVersion{
+	apiKeyFetch:       {sarama.MinVersion, sarama.V0_9_0_0, sarama.V0_10_0_0, sarama.V0_10_1_0, sarama.V0_11_0_0},
+	apiKeyListOffsets: {sarama.MinVersion, sarama.V0_10_1_0, sarama.V0_11_0_0},
+	apiKeyOffsetFetch: {sarama.MinVersion, sarama.V0_8_2_0, sarama.V0_10_2_0, sarama.V0_11_0_0, sarama.V2_0_0_0, sarama.V2_1_0_0},
+}
+
+// apiVersions caches the request versions supported by every broker, as
+// returned by ApiVersions. A broker is asked again after a request to it
+// failed, in case it was restarted with another version.
+type apiVersions struct {
+	mu      sync.Mutex
+	brokers map[int32]map[int16]int16
+}
+
+func newAPIVersions() *apiVersions {
+	return &apiVersions{brokers: make(map[int32]map[int16]int16)}
+}
+
+func (v *apiVersions) version(broker *sarama.Broker, key int16) int16 {
+	v.mu.Lock()
+	versions, ok := v.brokers[broker.ID()]
+	v.mu.Unlock()
+
+	if !ok {
+		versions = requestAPIVersions(broker)
+		v.mu.Lock()
+		v.brokers[broker.ID()] = versions
+		v.mu.Unlock()
+	}
+
+	max, ok := versions[key]
+	if !ok {
+		return fallbackVersions[key]
+	}
+	if max > supportedVersions[key] {
+		return supportedVersions[key]
+	}
+	return max
+}
+
+func (v *apiVersions) forget(broker *sarama.Broker) {
+	v.mu.Lock()
+	delete(v.brokers, broker.ID())
+	v.mu.Unlock()
+}
+
+// requestAPIVersions returns no versions when the broker can't tell them, so
+// the fallback versions are used until a request to the broker fails.
+func requestAPIVersions(broker *sarama.Broker) map[int16]int16 {
+	versions := make(map[int16]int16)
+
+	response, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+	if err == nil && response.Err != sarama.ErrNoError {
+		err = response.Err
+	}
+	if err != nil {
+		logp.Warn("Failed to get API versions of broker %s: %v", broker.Addr(), err)
+		return versions
+	}
+
+	for _, block := range response.ApiVersions {
+		versions[block.ApiKey] = block.MaxVersion
+	}
+	return versions
+}
+
+// requestVersion is the version of the request to send to the broker, the
+// fallback one when API versions are not negotiated, as allowed by
+// kafka_version.
+func (c *KafkaClient) requestVersion(broker *sarama.Broker, key int16) int16 {
+	version := fallbackVersions[key]
+	if c.versions != nil {
+		version = c.versions.version(broker, key)
+	}
+	return maxRequestVersion(key, version, c.kafkaVersion)
+}
+
+// maxRequestVersion lowers version to the newest one kafkaVersion allows.
+func maxRequestVersion(key, version int16, kafkaVersion sarama.KafkaVersion) int16 {
+	required, ok := requiredKafkaVersions[key]
+	if !ok {
+		return version
+	}
+	for version > 0 && (int(version) >= len(required) || !kafkaVersion.IsAtLeast(required[version])) {
+		version--
+	}
+	return version
+}
+
+func (c *KafkaClient) forgetVersions(broker *sarama.Broker) {
+	if c.versions != nil {
+		c.versions.forget(broker)
+	}
+}
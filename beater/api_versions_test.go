@@ -0,0 +1,213 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func apiVersionsResponse(versions map[int16]int16) *sarama.ApiVersionsResponse {
+	res := &sarama.ApiVersionsResponse{}
+	for key, max := range versions {
+		res.ApiVersions = append(res.ApiVersions, &sarama.ApiVersionsResponseBlock{ApiKey: key, MaxVersion: max})
+	}
+	return res
+}
+
+func TestGetOffsetEventsAPIVersions(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 2)
+
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 3}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 3}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	// Newer than supported, the newest supported version is used.
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 5}))
+	for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+		leader.Returns(&sarama.OffsetResponse{
+			Version: 2,
+			Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+				"test-topic": {
+					0: {Err: sarama.ErrNoError, Offset: offsets[0], Timestamp: -1},
+					1: {Err: sarama.ErrNoError, Offset: offsets[1], Timestamp: -1},
+				},
+			},
+		})
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		KafkaVersion:  "0.11.0.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal(int64(221), o2["broker_offset"].(int64))
+	assert.Equal(int64(220), o2["consumer_offset"].(int64))
+	assert.Equal(int64(21), o2["log_start_offset"].(int64))
+
+	for _, rr := range coordinator.History() {
+		if request, ok := rr.Request.(*sarama.OffsetFetchRequest); ok {
+			assert.Equal(int16(3), request.Version)
+		}
+	}
+	for _, rr := range leader.History() {
+		if request, ok := rr.Request.(*sarama.OffsetRequest); ok {
+			assert.Equal(int16(2), request.Version)
+		}
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsAPIVersionsKafkaVersion(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 2)
+
+	// The brokers are newer than kafka_version, the versions it allows are
+	// used.
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 3}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 1}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 2}))
+	for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+		offsetRes := new(sarama.OffsetResponse)
+		offsetRes.AddTopicPartition("test-topic", 0, offsets[0])
+		offsetRes.AddTopicPartition("test-topic", 1, offsets[1])
+		leader.Returns(offsetRes)
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		KafkaVersion:  "0.10.0.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.NotContains(o2, "error")
+	assert.Equal(int64(221), o2["broker_offset"].(int64))
+	assert.Equal(int64(220), o2["consumer_offset"].(int64))
+
+	for _, rr := range coordinator.History() {
+		if request, ok := rr.Request.(*sarama.OffsetFetchRequest); ok {
+			assert.Equal(int16(1), request.Version)
+		}
+	}
+	for _, rr := range leader.History() {
+		if request, ok := rr.Request.(*sarama.OffsetRequest); ok {
+			assert.Equal(int16(0), request.Version)
+		}
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestMaxRequestVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int16(2), maxRequestVersion(apiKeyListOffsets, 2, sarama.V0_11_0_0))
+	assert.Equal(int16(1), maxRequestVersion(apiKeyListOffsets, 2, sarama.V0_10_1_0))
+	assert.Equal(int16(0), maxRequestVersion(apiKeyListOffsets, 2, sarama.V0_10_0_0))
+	assert.Equal(int16(3), maxRequestVersion(apiKeyOffsetFetch, 5, sarama.V1_0_0_0))
+	assert.Equal(int16(1), maxRequestVersion(apiKeyOffsetFetch, 1, sarama.V0_9_0_0))
+	assert.Equal(int16(2), maxRequestVersion(apiKeyFetch, 4, sarama.V0_10_0_0))
+}
+
+func TestGetOffsetEventsReadCommitted(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 1)
+
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 1}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 1}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 90})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	// Log end, log start and last stable offsets.
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 2}))
+	for _, offset := range []int64{101, 0, 96} {
+		leader.Returns(&sarama.OffsetResponse{
+			Version: 2,
+			Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+				"test-topic": {0: {Err: sarama.ErrNoError, Offset: offset, Timestamp: -1}},
+			},
+		})
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:          []string{seedBroker.Addr()},
+		ConsumerGroup:  "test",
+		Topics:         []string{"test-topic"},
+		KafkaVersion:   "0.11.0.0",
+		IsolationLevel: "read_committed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o := events[0]["offset"].(common.MapStr)
+	assert.Equal(int64(10), o["lag"])
+	assert.Equal(int64(95), o["last_stable_offset"])
+	assert.Equal(int64(5), o["lag_committed"])
+	assert.Equal(int64(5), o["hwm_lso_gap"])
+
+	var requests []string
+	for _, e := range events {
+		if b, ok := e["broker"].(common.MapStr); ok {
+			requests = append(requests, b["request"].(string))
+		}
+	}
+	assert.Equal([]string{"log_end_offsets", "log_start_offsets", "last_stable_offsets"}, requests)
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
@@ -0,0 +1,173 @@
+package beater
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+var (
+	errReadCommittedUnsupported = errors.New("broker doesn't support read_committed offset requests")
+	errPreviousRequestPending   = errors.New("previous offset request to the broker timed out and hasn't returned")
+)
+
+// brokerResponse is the outcome of an offset request sent to one broker.
+type brokerResponse struct {
+	broker   *sarama.Broker
+	request  *brokerOffsetRequest
+	response *sarama.OffsetResponse
+	err      error
+	elapsed  time.Duration
+}
+
+func (r *brokerResponse) event() common.MapStr {
+	request := "log_end_offsets"
+	switch {
+	case r.request.at == sarama.OffsetOldest:
+		request = "log_start_offsets"
+	case r.request.isolation == sarama.ReadCommitted:
+		request = "last_stable_offsets"
+	}
+
+	partitions := 0
+	for _, p := range r.request.partitions {
+		partitions += len(p)
+	}
+
+	event := common.MapStr{
+		"id":                    r.broker.ID(),
+		"address":               r.broker.Addr(),
+		"request":               request,
+		"partition_count":       partitions,
+		"response_time_seconds": r.elapsed.Seconds(),
+	}
+	if r.err != nil {
+		event["error"] = r.err.Error()
+	}
+	return event
+}
+
+// sendOffsetRequests sends the requests to their brokers in parallel, at most
+// brokerConcurrency at a time, so a slow broker doesn't hold up the others.
+// Requests still waiting for a slot when brokerTimeout is up aren't sent.
+func (c *KafkaClient) sendOffsetRequests(requests map[*sarama.Broker]*brokerOffsetRequest) []*brokerResponse {
+	sem := make(chan struct{}, c.brokerConcurrency)
+	results := make(chan *brokerResponse, len(requests))
+
+	start := time.Now()
+	expired := make(chan struct{})
+	timer := time.AfterFunc(c.brokerTimeout, func() { close(expired) })
+	defer timer.Stop()
+
+	for broker, r := range requests {
+		go func(broker *sarama.Broker, r *brokerOffsetRequest) {
+			if c.stragglers.has(broker) {
+				results <- &brokerResponse{broker: broker, request: r, err: errPreviousRequestPending}
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+				results <- c.sendOffsetRequest(broker, r, start, expired, func() { <-sem })
+			case <-expired:
+				results <- &brokerResponse{
+					broker:  broker,
+					request: r,
+					err:     sarama.ErrRequestTimedOut,
+					elapsed: c.brokerTimeout,
+				}
+			}
+		}(broker, r)
+	}
+
+	responses := make([]*brokerResponse, 0, len(requests))
+	for range requests {
+		responses = append(responses, <-results)
+	}
+	return responses
+}
+
+// sendOffsetRequest gives up waiting for the broker once expired is closed.
+// The request itself can't be cancelled and is left to the client's own
+// timeouts, its slot is released right away and the broker is remembered as
+// a straggler until it returns.
+func (c *KafkaClient) sendOffsetRequest(broker *sarama.Broker, r *brokerOffsetRequest, start time.Time, expired <-chan struct{}, release func()) *brokerResponse {
+	done := make(chan *brokerResponse, 1)
+
+	go func() {
+		r.request.Version = c.requestVersion(broker, apiKeyListOffsets)
+
+		var response *sarama.OffsetResponse
+		var err error
+		if r.isolation == sarama.ReadCommitted && r.request.Version < 2 {
+			// Older requests would silently return the high watermark.
+			err = errReadCommittedUnsupported
+		} else {
+			response, err = broker.GetAvailableOffsets(r.request)
+			if err != nil {
+				c.forgetVersions(broker)
+			}
+		}
+		done <- &brokerResponse{
+			broker:   broker,
+			request:  r,
+			response: response,
+			err:      err,
+			elapsed:  time.Since(start),
+		}
+	}()
+
+	defer release()
+
+	select {
+	case res := <-done:
+		return res
+	case <-expired:
+		c.stragglers.add(broker)
+		go func() {
+			<-done
+			c.stragglers.remove(broker)
+		}()
+
+		return &brokerResponse{
+			broker:  broker,
+			request: r,
+			err:     sarama.ErrRequestTimedOut,
+			elapsed: c.brokerTimeout,
+		}
+	}
+}
+
+// stragglerSet holds the brokers with a timed out request that hasn't
+// returned yet. A broker answers the requests on its connection in order, so
+// no more are sent to it until then, which also bounds the stragglers to one
+// per broker.
+type stragglerSet struct {
+	mu      sync.Mutex
+	brokers map[*sarama.Broker]bool
+}
+
+func (s *stragglerSet) add(broker *sarama.Broker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.brokers == nil {
+		s.brokers = make(map[*sarama.Broker]bool)
+	}
+	s.brokers[broker] = true
+}
+
+func (s *stragglerSet) remove(broker *sarama.Broker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.brokers, broker)
+}
+
+func (s *stragglerSet) has(broker *sarama.Broker) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.brokers[broker]
+}
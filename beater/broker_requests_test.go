@@ -0,0 +1,189 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerResponseEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newBrokerOffsetRequest(sarama.OffsetOldest, sarama.ReadUncommitted)
+	r.addBlock("t1", 0)
+	r.addBlock("t1", 1)
+	r.addBlock("t2", 0)
+
+	res := &brokerResponse{
+		broker:  sarama.NewBroker("localhost:9092"),
+		request: r,
+		err:     sarama.ErrRequestTimedOut,
+		elapsed: 1500 * time.Millisecond,
+	}
+
+	event := res.event()
+	assert.Equal("localhost:9092", event["address"])
+	assert.Equal("log_start_offsets", event["request"])
+	assert.Equal(3, event["partition_count"])
+	assert.Equal(1.5, event["response_time_seconds"])
+	assert.Equal(sarama.ErrRequestTimedOut.Error(), event["error"])
+
+	res.request = newBrokerOffsetRequest(sarama.OffsetNewest, sarama.ReadCommitted)
+	assert.Equal("last_stable_offsets", res.event()["request"])
+}
+
+func openMockBroker(t *testing.T, mock *sarama.MockBroker) *sarama.Broker {
+	conf := sarama.NewConfig()
+	conf.Version = sarama.V0_9_0_0
+
+	broker := sarama.NewBroker(mock.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func newTestOffsetRequest() *brokerOffsetRequest {
+	r := newBrokerOffsetRequest(sarama.OffsetNewest, sarama.ReadUncommitted)
+	r.addBlock("test-topic", 0)
+	return r
+}
+
+func TestSendOffsetRequestsTimeout(t *testing.T) {
+	slow := sarama.NewMockBroker(t, 1)
+	fast := sarama.NewMockBroker(t, 2)
+	slow.SetLatency(200 * time.Millisecond)
+
+	offsetRes := new(sarama.OffsetResponse)
+	offsetRes.AddTopicPartition("test-topic", 0, 111)
+	slow.Returns(offsetRes)
+	fast.Returns(offsetRes)
+
+	slowBroker := openMockBroker(t, slow)
+	fastBroker := openMockBroker(t, fast)
+
+	c := &KafkaClient{brokerConcurrency: 2, brokerTimeout: 50 * time.Millisecond}
+	responses := c.sendOffsetRequests(map[*sarama.Broker]*brokerOffsetRequest{
+		slowBroker: newTestOffsetRequest(),
+		fastBroker: newTestOffsetRequest(),
+	})
+
+	assert := assert.New(t)
+	assert.Len(responses, 2)
+	for _, res := range responses {
+		if res.broker == slowBroker {
+			assert.Equal(sarama.ErrRequestTimedOut, res.err)
+			assert.Equal(50*time.Millisecond, res.elapsed)
+		} else {
+			assert.NoError(res.err)
+			assert.Equal(int64(111), res.response.GetBlock("test-topic", 0).Offsets[0])
+		}
+	}
+
+	slowBroker.Close()
+	fastBroker.Close()
+	slow.Close()
+	fast.Close()
+}
+
+func TestSendOffsetRequestsConcurrency(t *testing.T) {
+	first := sarama.NewMockBroker(t, 1)
+	second := sarama.NewMockBroker(t, 2)
+
+	offsetRes := new(sarama.OffsetResponse)
+	offsetRes.AddTopicPartition("test-topic", 0, 111)
+	for _, mock := range []*sarama.MockBroker{first, second} {
+		mock.SetLatency(100 * time.Millisecond)
+		mock.Returns(offsetRes)
+	}
+
+	firstBroker := openMockBroker(t, first)
+	secondBroker := openMockBroker(t, second)
+
+	// The second request is only sent once the first one returned, the
+	// time it waited for its slot is part of its response time.
+	c := &KafkaClient{brokerConcurrency: 1, brokerTimeout: time.Second}
+	responses := c.sendOffsetRequests(map[*sarama.Broker]*brokerOffsetRequest{
+		firstBroker:  newTestOffsetRequest(),
+		secondBroker: newTestOffsetRequest(),
+	})
+
+	assert := assert.New(t)
+	assert.Len(responses, 2)
+	var slowest time.Duration
+	for _, res := range responses {
+		assert.NoError(res.err)
+		if res.elapsed > slowest {
+			slowest = res.elapsed
+		}
+	}
+	assert.True(slowest >= 200*time.Millisecond)
+
+	firstBroker.Close()
+	secondBroker.Close()
+	first.Close()
+	second.Close()
+}
+
+func TestSendOffsetRequestsHungBrokers(t *testing.T) {
+	offsetRes := new(sarama.OffsetResponse)
+	offsetRes.AddTopicPartition("test-topic", 0, 111)
+
+	var mocks []*sarama.MockBroker
+	var brokers []*sarama.Broker
+	for id := int32(1); id <= 3; id++ {
+		mock := sarama.NewMockBroker(t, id)
+		mock.SetLatency(300 * time.Millisecond)
+		mock.SetHandlerByMap(map[string]sarama.MockResponse{
+			"OffsetRequest": sarama.NewMockWrapper(offsetRes),
+		})
+		mocks = append(mocks, mock)
+		brokers = append(brokers, openMockBroker(t, mock))
+	}
+
+	newRequests := func() map[*sarama.Broker]*brokerOffsetRequest {
+		requests := make(map[*sarama.Broker]*brokerOffsetRequest)
+		for _, broker := range brokers {
+			requests[broker] = newTestOffsetRequest()
+		}
+		return requests
+	}
+
+	// More brokers than slots: the ones waiting for a slot time out along
+	// with the one that was sent.
+	c := &KafkaClient{brokerConcurrency: 1, brokerTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	responses := c.sendOffsetRequests(newRequests())
+
+	assert := assert.New(t)
+	assert.True(time.Since(start) < 200*time.Millisecond)
+	assert.Len(responses, 3)
+	for _, res := range responses {
+		assert.Equal(sarama.ErrRequestTimedOut, res.err)
+		assert.Equal(50*time.Millisecond, res.elapsed)
+	}
+
+	// The broker whose request is still running isn't sent another one
+	// until it returns.
+	responses = c.sendOffsetRequests(newRequests())
+	pending := 0
+	for _, res := range responses {
+		if res.err == errPreviousRequestPending {
+			pending++
+		}
+	}
+	assert.Equal(1, pending)
+
+	time.Sleep(700 * time.Millisecond)
+	c.brokerConcurrency, c.brokerTimeout = 3, time.Second
+	for _, res := range c.sendOffsetRequests(newRequests()) {
+		assert.NoError(res.err)
+	}
+
+	for i := range mocks {
+		brokers[i].Close()
+		mocks[i].Close()
+	}
+}
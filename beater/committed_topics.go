@@ -0,0 +1,94 @@
+package beater
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+var errOffsetFetchAllUnsupported = errors.New("coordinator doesn't support fetching all offsets of a group")
+
+// topicScan is the set of topics a group had committed offsets for when the
+// partitions of every topic in the cluster were last scanned.
+type topicScan struct {
+	topics  []string
+	scanned time.Time
+}
+
+// committedTopicCandidates returns the topics to ask the committed offsets
+// of a group for. Coordinators supporting OffsetFetch v2 list them in one
+// request. Otherwise every topic in the cluster is scanned, which costs a
+// request for all of its partitions, so the result is kept for
+// metadata.refresh_frequency. scan reports whether the candidates are every
+// topic of the cluster.
+func (c *KafkaClient) committedTopicCandidates(group config.ConsumerGroupConfig, clusterTopics []string, now time.Time) (candidates []string, scan bool) {
+	all := []*topicPattern{{name: "*", glob: true}}
+
+	if group.OffsetStorage == "" || group.OffsetStorage == offsetStorageKafka {
+		topics, err := c.fetchCommittedTopics(group.Name)
+		if err == nil {
+			return resolveTopics(all, topics, c.includeInternal), false
+		}
+		if err != errOffsetFetchAllUnsupported {
+			logp.Debug("kafkabeat", "Failed to list committed topics of group %s: %v", group.Name, err)
+		}
+	}
+
+	if s, ok := c.topicScans[group.Name]; ok {
+		return s.topics, false
+	}
+	return resolveTopics(all, clusterTopics, c.includeInternal), true
+}
+
+// fetchCommittedTopics asks the coordinator for every offset of a group with
+// a single OffsetFetch request without topics, supported from version 2 on.
+func (c *KafkaClient) fetchCommittedTopics(group string) ([]string, error) {
+	broker, err := c.client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &sarama.OffsetFetchRequest{
+		Version:       c.requestVersion(broker, apiKeyOffsetFetch),
+		ConsumerGroup: group,
+	}
+	if request.Version < 2 {
+		return nil, errOffsetFetchAllUnsupported
+	}
+
+	response, err := broker.FetchOffset(request)
+	if err != nil {
+		c.forgetVersions(broker)
+		return nil, err
+	}
+	if response.Err != sarama.ErrNoError {
+		return nil, response.Err
+	}
+
+	var topics []string
+	for topic, blocks := range response.Blocks {
+		for _, block := range blocks {
+			if block.Err == sarama.ErrNoError && block.Offset >= 0 {
+				topics = append(topics, topic)
+				break
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// pruneTopicScans forgets the scans which expired, including those of
+// groups that are gone.
+func (c *KafkaClient) pruneTopicScans(now time.Time) {
+	for group, s := range c.topicScans {
+		if now.Sub(s.scanned) >= c.client.Config().Metadata.RefreshFrequency {
+			delete(c.topicScans, group)
+		}
+	}
+}
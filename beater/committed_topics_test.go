@@ -0,0 +1,142 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+// committedTopicsMetadata has test-topic with two partitions and other-topic,
+// which the group hasn't committed offsets for. The coordinator is listed so
+// it is still known after the metadata is refreshed.
+func committedTopicsMetadata(coordinator, leader *sarama.MockBroker, version int16) *sarama.MetadataResponse {
+	metadataRes := metadataResponse(leader, version, 2)
+	metadataRes.AddBroker(coordinator.Addr(), coordinator.BrokerID())
+	metadataRes.AddTopicPartition("other-topic", 0, leader.BrokerID(), nil, nil, nil, sarama.ErrNoError)
+	return metadataRes
+}
+
+func offsetTopics(events []common.MapStr) []string {
+	var topics []string
+	for _, event := range events {
+		if event["type"] == "offset" {
+			topics = append(topics, event["offset"].(common.MapStr)["topic"].(string))
+		}
+	}
+	return topics
+}
+
+func TestGetOffsetEventsCommittedTopicsFetchAll(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	seedBroker.Returns(committedTopicsMetadata(coordinator, leader, 1))
+	seedBroker.Returns(committedTopicsMetadata(coordinator, leader, 1))
+	seedBroker.Returns(coordinatorResponse(coordinator))
+
+	// The committed topics are listed with one request without topics, then
+	// their offsets are fetched.
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 3}))
+	for i := 0; i < 2; i++ {
+		offsetFetchRes := &sarama.OffsetFetchResponse{Version: 3}
+		offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+		offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+		offsetFetchRes.AddBlock("other-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: -1})
+		coordinator.Returns(offsetFetchRes)
+	}
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 2}))
+	for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+		leader.Returns(&sarama.OffsetResponse{
+			Version: 2,
+			Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+				"test-topic": {
+					0: {Err: sarama.ErrNoError, Offset: offsets[0], Timestamp: -1},
+					1: {Err: sarama.ErrNoError, Offset: offsets[1], Timestamp: -1},
+				},
+			},
+		})
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:           []string{seedBroker.Addr()},
+		ConsumerGroup:   "test",
+		CommittedTopics: true,
+		KafkaVersion:    "0.11.0.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+	assert.Equal([]string{"test-topic", "test-topic"}, offsetTopics(events))
+
+	requests := 0
+	for _, rr := range coordinator.History() {
+		if _, ok := rr.Request.(*sarama.OffsetFetchRequest); ok {
+			requests++
+		}
+	}
+	assert.Equal(2, requests)
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsCommittedTopicsScan(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	seedBroker.Returns(committedTopicsMetadata(coordinator, leader, 0))
+	seedBroker.Returns(committedTopicsMetadata(coordinator, leader, 0))
+	seedBroker.Returns(coordinatorResponse(coordinator))
+	seedBroker.Returns(committedTopicsMetadata(coordinator, leader, 0))
+
+	// The group commits to other-topic after the first period. The scan is
+	// kept, so it isn't asked for and not reported.
+	for _, otherOffset := range []int64{-1, 5} {
+		offsetFetchRes := new(sarama.OffsetFetchResponse)
+		offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+		offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+		offsetFetchRes.AddBlock("other-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: otherOffset})
+		coordinator.Returns(offsetFetchRes)
+		coordinator.Returns(describeGroupsResponse("test", nil))
+
+		for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+			offsetRes := new(sarama.OffsetResponse)
+			offsetRes.AddTopicPartition("test-topic", 0, offsets[0])
+			offsetRes.AddTopicPartition("test-topic", 1, offsets[1])
+			leader.Returns(offsetRes)
+		}
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:           []string{seedBroker.Addr()},
+		ConsumerGroup:   "test",
+		CommittedTopics: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	assert.Equal([]string{"test-topic", "test-topic"}, offsetTopics(client.GetOffsetEvents()))
+	assert.Equal([]string{"test-topic"}, client.topicScans["test"].topics)
+	assert.Equal([]string{"test-topic", "test-topic"}, offsetTopics(client.GetOffsetEvents()))
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
@@ -0,0 +1,146 @@
+package beater
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+const consumerProtocolType = "consumer"
+
+type groupDiscovery struct {
+	client   sarama.Client
+	config   *sarama.Config
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	interval time.Duration
+
+	groups      []string
+	lastRefresh time.Time
+}
+
+func newGroupDiscovery(client sarama.Client, saramaConfig *sarama.Config, conf *config.GroupDiscoveryConfig) (*groupDiscovery, error) {
+	if conf.RefreshInterval == "" {
+		conf.RefreshInterval = "1m"
+	}
+
+	interval, err := time.ParseDuration(conf.RefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	include, err := compilePatterns(conf.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := compilePatterns(conf.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &groupDiscovery{
+		client:   client,
+		config:   saramaConfig,
+		include:  include,
+		exclude:  exclude,
+		interval: interval,
+	}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func matchAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *groupDiscovery) Groups() []string {
+	if d.lastRefresh.IsZero() || time.Since(d.lastRefresh) >= d.interval {
+		groups, err := d.listGroups()
+		if err != nil {
+			logp.Err("Failed to discover consumer groups: %v", err)
+			return d.groups
+		}
+
+		d.groups = groups
+		d.lastRefresh = time.Now()
+	}
+	return d.groups
+}
+
+func (d *groupDiscovery) match(group string) bool {
+	if len(d.include) > 0 && !matchAny(d.include, group) {
+		return false
+	}
+	return !matchAny(d.exclude, group)
+}
+
+func (d *groupDiscovery) listGroups() ([]string, error) {
+	brokers := d.client.Brokers()
+	if len(brokers) == 0 {
+		return nil, sarama.ErrOutOfBrokers
+	}
+
+	found := make(map[string]bool)
+	var lastErr error
+	var succeeded int
+
+	for _, broker := range brokers {
+		if ok, _ := broker.Connected(); !ok {
+			if err := broker.Open(d.config); err != nil && err != sarama.ErrAlreadyConnected {
+				logp.Warn("Failed to connect to broker %s: %v", broker.Addr(), err)
+				lastErr = err
+				continue
+			}
+		}
+
+		response, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err == nil && response.Err != sarama.ErrNoError {
+			err = response.Err
+		}
+		if err != nil {
+			logp.Warn("Failed to list groups on broker %s: %v", broker.Addr(), err)
+			lastErr = err
+			continue
+		}
+		succeeded++
+
+		for group, protocolType := range response.Groups {
+			if protocolType == consumerProtocolType && d.match(group) {
+				found[group] = true
+			}
+		}
+	}
+
+	if succeeded == 0 {
+		return nil, lastErr
+	}
+
+	groups := make([]string, 0, len(found))
+	for group := range found {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
@@ -0,0 +1,74 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func TestGroupDiscoveryMatch(t *testing.T) {
+	d, err := newGroupDiscovery(nil, nil, &config.GroupDiscoveryConfig{
+		Include: []string{"^app-"},
+		Exclude: []string{"-test$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	assert.True(d.match("app-orders"))
+	assert.False(d.match("app-orders-test"))
+	assert.False(d.match("other"))
+}
+
+func TestGroupDiscoveryInvalidPattern(t *testing.T) {
+	_, err := newGroupDiscovery(nil, nil, &config.GroupDiscoveryConfig{
+		Include: []string{"("},
+	})
+	assert.Error(t, err)
+}
+
+func TestGetOffsetEventsDiscoveredGroups(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	leader.Returns(&sarama.ListGroupsResponse{
+		Err: sarama.ErrNoError,
+		Groups: map[string]string{
+			"test":            "consumer",
+			"test-ignored":    "consumer",
+			"connect-cluster": "connect",
+		},
+	})
+	initBrokers(seedBroker, coordinator, leader)
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:  []string{seedBroker.Addr()},
+		Topics: []string{"test-topic"},
+		GroupDiscovery: config.GroupDiscoveryConfig{
+			Enabled: true,
+			Exclude: []string{"-ignored$"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+	assert.Len(events, 6)
+	for _, event := range events[:2] {
+		assert.Equal("test", event["offset"].(common.MapStr)["group"].(string))
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
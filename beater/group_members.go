@@ -0,0 +1,103 @@
+package beater
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// partitionOwners maps every partition assigned in a group to the member
+// consuming it.
+type partitionOwners map[partitionKey]*groupMember
+
+func (g *groupMetadata) partitionOwners() (partitionOwners, error) {
+	if g.ProtocolType != "" && g.ProtocolType != consumerProtocolType {
+		return nil, fmt.Errorf("group %s uses protocol type %q", g.Group, g.ProtocolType)
+	}
+
+	owners := make(partitionOwners)
+	for _, member := range g.Members {
+		if len(member.Assignment) == 0 {
+			continue
+		}
+
+		assignment, err := decodeMemberAssignment(member.Assignment)
+		if err != nil {
+			logp.Warn("Failed to decode assignment of member %s in group %s: %v", member.MemberID, g.Group, err)
+			continue
+		}
+		for topic, partitions := range assignment {
+			for _, partition := range partitions {
+				owners[partitionKey{topic, partition}] = member
+			}
+		}
+	}
+	return owners, nil
+}
+
+func (c *KafkaClient) describeGroup(group string) (*groupMetadata, error) {
+	broker, err := c.client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := broker.DescribeGroups(&sarama.DescribeGroupsRequest{Groups: []string{group}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, description := range response.Groups {
+		if description.GroupId != group {
+			continue
+		}
+		if description.Err != sarama.ErrNoError {
+			return nil, description.Err
+		}
+
+		metadata := &groupMetadata{
+			Group:        group,
+			State:        description.State,
+			Coordinator:  broker.ID(),
+			ProtocolType: description.ProtocolType,
+			Protocol:     description.Protocol,
+		}
+		for memberID, member := range description.Members {
+			metadata.Members = append(metadata.Members, &groupMember{
+				MemberID:   memberID,
+				ClientID:   member.ClientId,
+				ClientHost: member.ClientHost,
+				Assignment: member.MemberAssignment,
+			})
+		}
+		return metadata, nil
+	}
+	return nil, sarama.ErrIncompleteResponse
+}
+
+// decodeMemberAssignment decodes the ConsumerGroupMemberAssignment a group
+// leader hands out to a member of a consumer group.
+func decodeMemberAssignment(b []byte) (map[string][]int32, error) {
+	d := &offsetsTopicDecoder{buf: b}
+
+	d.int16() // version
+	assignment := make(map[string][]int32)
+
+	n := d.int32()
+	for i := int32(0); i < n && d.err == nil; i++ {
+		topic := d.string()
+
+		m := d.int32()
+		partitions := make([]int32, 0, positiveNum(int64(m)))
+		for j := int32(0); j < m && d.err == nil; j++ {
+			partitions = append(partitions, d.int32())
+		}
+		assignment[topic] = partitions
+	}
+	d.bytes() // user data
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return assignment, nil
+}
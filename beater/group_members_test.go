@@ -0,0 +1,50 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeMemberAssignment(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &testEncoder{}
+	e.int16(0).int32(2)
+	e.string("t1").int32(2).int32(0).int32(2)
+	e.string("t2").int32(0)
+	e.bytes([]byte{1})
+
+	assignment, err := decodeMemberAssignment(e.Bytes())
+	assert.NoError(err)
+	assert.Equal(map[string][]int32{"t1": {0, 2}, "t2": {}}, assignment)
+
+	e = &testEncoder{}
+	_, err = decodeMemberAssignment(e.int16(0).int32(1).string("t1").Bytes())
+	assert.Error(err)
+}
+
+func TestGroupMetadataPartitionOwners(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &testEncoder{}
+	e.int16(0).int32(1).string("t1").int32(1).int32(3).bytes(nil)
+
+	member := &groupMember{MemberID: "member-1", Assignment: e.Bytes()}
+	metadata := &groupMetadata{
+		Group:        "test",
+		ProtocolType: "consumer",
+		Members:      []*groupMember{member, {MemberID: "member-2"}},
+	}
+
+	owners, err := metadata.partitionOwners()
+	assert.NoError(err)
+	assert.Equal(partitionOwners{{"t1", 3}: member}, owners)
+
+	owners, err = (&groupMetadata{Group: "test", State: "Empty"}).partitionOwners()
+	assert.NoError(err)
+	assert.Empty(owners)
+
+	_, err = (&groupMetadata{Group: "test", ProtocolType: "connect"}).partitionOwners()
+	assert.Error(err)
+}
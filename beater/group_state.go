@@ -0,0 +1,114 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	groupStateStable              = "Stable"
+	groupStateEmpty               = "Empty"
+	groupStatePreparingRebalance  = "PreparingRebalance"
+	groupStateCompletingRebalance = "CompletingRebalance"
+	// Brokers before 2.0 call CompletingRebalance AwaitingSync.
+	groupStateAwaitingSync = "AwaitingSync"
+)
+
+func isRebalancing(state string) bool {
+	switch state {
+	case groupStatePreparingRebalance, groupStateCompletingRebalance, groupStateAwaitingSync:
+		return true
+	default:
+		return false
+	}
+}
+
+type trackedGroup struct {
+	state          string
+	since          time.Time
+	rebalanceStart time.Time
+	rebalances     int
+	lastRebalance  time.Duration
+	lastSeen       time.Time
+}
+
+// groupStateTracker remembers the state of every group between periods to
+// count rebalances and measure how long they last. Durations are only as
+// precise as the period.
+type groupStateTracker struct {
+	groups map[string]*trackedGroup
+}
+
+func newGroupStateTracker() *groupStateTracker {
+	return &groupStateTracker{groups: make(map[string]*trackedGroup)}
+}
+
+// observe records the current state of a group and returns a rebalance
+// event when it differs from the previous one.
+func (t *groupStateTracker) observe(g *groupMetadata, now time.Time) common.MapStr {
+	tg, ok := t.groups[g.Group]
+	if !ok {
+		tg = &trackedGroup{state: g.State, since: now}
+		if isRebalancing(g.State) {
+			tg.rebalanceStart = now
+			tg.rebalances++
+		}
+		t.groups[g.Group] = tg
+	}
+	tg.lastSeen = now
+
+	if tg.state == g.State {
+		return nil
+	}
+
+	event := common.MapStr{
+		"group":                           g.Group,
+		"previous_state":                  tg.state,
+		"state":                           g.State,
+		"previous_state_duration_seconds": now.Sub(tg.since).Seconds(),
+	}
+
+	switch {
+	case !isRebalancing(tg.state) && isRebalancing(g.State):
+		tg.rebalanceStart = now
+		tg.rebalances++
+	case isRebalancing(tg.state) && !isRebalancing(g.State):
+		tg.lastRebalance = now.Sub(tg.rebalanceStart)
+		tg.rebalanceStart = time.Time{}
+		event["rebalance_duration_seconds"] = tg.lastRebalance.Seconds()
+	}
+	event["rebalance_count"] = tg.rebalances
+
+	tg.state = g.State
+	tg.since = now
+	return event
+}
+
+func (t *groupStateTracker) prune(cutoff time.Time) {
+	for group, tg := range t.groups {
+		if tg.lastSeen.Before(cutoff) {
+			delete(t.groups, group)
+		}
+	}
+}
+
+func (t *groupStateTracker) event(g *groupMetadata, now time.Time) common.MapStr {
+	event := common.MapStr{
+		"group":         g.Group,
+		"state":         g.State,
+		"protocol_type": g.ProtocolType,
+		"protocol":      g.Protocol,
+		"member_count":  len(g.Members),
+		"coordinator":   g.Coordinator,
+	}
+
+	if tg, ok := t.groups[g.Group]; ok {
+		event["state_duration_seconds"] = now.Sub(tg.since).Seconds()
+		event["rebalance_count"] = tg.rebalances
+		if tg.lastRebalance > 0 {
+			event["last_rebalance_duration_seconds"] = tg.lastRebalance.Seconds()
+		}
+	}
+	return event
+}
@@ -0,0 +1,44 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupStateTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newGroupStateTracker()
+	start := time.Unix(1462174414, 0)
+	observe := func(state string, seconds int) map[string]interface{} {
+		return tracker.observe(&groupMetadata{Group: "test", State: state}, start.Add(time.Duration(seconds)*time.Second))
+	}
+
+	assert.Nil(observe("Stable", 0))
+	assert.Nil(observe("Stable", 10))
+
+	event := observe("PreparingRebalance", 20)
+	assert.Equal("Stable", event["previous_state"])
+	assert.Equal("PreparingRebalance", event["state"])
+	assert.Equal(20.0, event["previous_state_duration_seconds"])
+	assert.Equal(1, event["rebalance_count"])
+	assert.NotContains(event, "rebalance_duration_seconds")
+
+	event = observe("CompletingRebalance", 30)
+	assert.Equal(1, event["rebalance_count"])
+	assert.NotContains(event, "rebalance_duration_seconds")
+
+	event = observe("Stable", 45)
+	assert.Equal(1, event["rebalance_count"])
+	assert.Equal(25.0, event["rebalance_duration_seconds"])
+
+	g := tracker.event(&groupMetadata{Group: "test", State: "Stable"}, start.Add(50*time.Second))
+	assert.Equal(1, g["rebalance_count"])
+	assert.Equal(25.0, g["last_rebalance_duration_seconds"])
+	assert.Equal(5.0, g["state_duration_seconds"])
+
+	tracker.prune(start.Add(time.Minute))
+	assert.Empty(tracker.groups)
+}
@@ -1,27 +1,96 @@
 package beater
 
 import (
+	"errors"
+	"fmt"
 	// "log"
 	// "os"
+	"sort"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
+
+	"github.com/daichirata/kafkabeat/config"
 )
 
 type KafkaClient struct {
-	client sarama.Client
-	group  string
-	topics []string
+	client    sarama.Client
+	groups    []config.ConsumerGroupConfig
+	topics    []*topicPattern
+	discovery *groupDiscovery
+	history   *brokerOffsetHistory
+	logStarts *brokerOffsetHistory
+	windows   *consumerWindows
+	commits   *commitTracker
+	states    *groupStateTracker
+	rates     *rateTracker
+
+	offsetsTopic *offsetsTopicCollector
+	zookeeper    *ZookeeperClient
+
+	groupTopics     map[string][]*topicPattern
+	includeInternal bool
+	committedTopics bool
+	topicScans      map[string]*topicScan
+	refreshMetadata bool
+	uncommittedLag  string
+	lagEvents       string
+	lagThreshold    int64
+	partitionEvents bool
+
+	brokerConcurrency int
+	brokerTimeout     time.Duration
+	stragglers        stragglerSet
+	retryMax          int
+	retryBackoff      time.Duration
+	kafkaVersion      sarama.KafkaVersion
+	versions          *apiVersions
+	isolationLevel    sarama.IsolationLevel
+	timestamps        *timestampCache
 }
 
+const (
+	offsetStorageKafka     = "kafka"
+	offsetStorageZookeeper = "zookeeper"
+	offsetStorageBoth      = "both"
+
+	uncommittedLagLogStart = "log_start"
+	uncommittedLagLogEnd   = "log_end"
+	uncommittedLagNone     = "none"
+
+	lagEventsPartitions = "partitions"
+	lagEventsRollups    = "rollups"
+	lagEventsBoth       = "both"
+)
+
+const (
+	isolationLevelReadUncommitted = "read_uncommitted"
+	isolationLevelReadCommitted   = "read_committed"
+)
+
 type Offset struct {
-	Group          string
-	Topic          string
-	Partition      int32
-	ConsumerOffset int64
-	BrokerOffset   int64
+	Group           string
+	Topic           string
+	Partition       int32
+	Committed       bool
+	ConsumerOffset  int64
+	BrokerOffset    int64
+	HighWatermark   int64
+	LogStartOffset  int64
+	Lag             int64
+	HasLag          bool
+	LastStable      int64
+	HasLastStable   bool
+	LagCommitted    int64
+	HasLagCommitted bool
+	LagMs           int64
+	HasLagMs        bool
+	CommitTimestamp time.Time
+	Owner           *groupMember
+	OwnersKnown     bool
+	Err             error
 }
 
 type consumerOffsetRequest struct {
@@ -30,6 +99,8 @@ type consumerOffsetRequest struct {
 }
 
 type brokerOffsetRequest struct {
+	at         int64
+	isolation  sarama.IsolationLevel
 	partitions topicPartitions
 	request    *sarama.OffsetRequest
 }
@@ -38,34 +109,441 @@ type topicPartitions map[string][]int32
 type partitionOffset map[int32]int64
 type partitionOffsets map[string]partitionOffset
 
-func NewKafkaClient(hosts []string, group string, topics []string) (*KafkaClient, error) {
+// partitionErrors holds the errors of the partitions that failed, so the
+// others can still be reported.
+type partitionErrors map[partitionKey]error
+
+func (pe partitionErrors) addAll(tp topicPartitions, err error) {
+	for topic, partitions := range tp {
+		for _, partition := range partitions {
+			pe[partitionKey{topic, partition}] = err
+		}
+	}
+}
+
+// missingFrom keeps the errors of the partitions that have no committed
+// offset in offsets, the others are reported with that offset.
+func (pe partitionErrors) missingFrom(offsets partitionOffsets) partitionErrors {
+	errs := make(partitionErrors)
+	for key, err := range pe {
+		if offset, ok := offsets[key.topic][key.partition]; !ok || offset < 0 {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+// topicErrors holds the errors of the topics whose partitions couldn't be
+// read, such as topics missing from the cluster.
+type topicErrors map[string]error
+
+func (tp topicPartitions) topics() []string {
+	topics := make([]string, 0, len(tp))
+	for topic := range tp {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// topicsWith returns the failed topics along with the topics of tp, sorted.
+func (te topicErrors) topicsWith(tp topicPartitions) []string {
+	topics := tp.topics()
+	for topic := range te {
+		if _, ok := tp[topic]; !ok {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (po partitionOffsets) hasCommitted(topic string) bool {
+	for _, offset := range po[topic] {
+		if offset >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func NewKafkaClient(conf *config.KafkabeatConfig) (*KafkaClient, error) {
+	groups := conf.ConsumerGroups
+	if conf.ConsumerGroup != "" {
+		groups = append([]config.ConsumerGroupConfig{{Name: conf.ConsumerGroup}}, groups...)
+	}
+
+	topics, err := parseTopicPatterns(conf.Topics)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.OffsetHistory == "" {
+		conf.OffsetHistory = "1h"
+	}
+	offsetHistory, err := time.ParseDuration(conf.OffsetHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.LagWindowSize <= 0 {
+		conf.LagWindowSize = 10
+	}
+
+	if conf.BrokerConcurrency <= 0 {
+		conf.BrokerConcurrency = 10
+	}
+	if conf.BrokerTimeout == "" {
+		conf.BrokerTimeout = "10s"
+	}
+	brokerTimeout, err := time.ParseDuration(conf.BrokerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case conf.Retry.Max == 0:
+		conf.Retry.Max = 3
+	case conf.Retry.Max < 0:
+		conf.Retry.Max = 0
+	}
+	if conf.Retry.Backoff == "" {
+		conf.Retry.Backoff = "250ms"
+	}
+	retryBackoff, err := time.ParseDuration(conf.Retry.Backoff)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &KafkaClient{
+		groups:          groups,
+		topics:          topics,
+		history:         newBrokerOffsetHistory(offsetHistory),
+		logStarts:       newBrokerOffsetHistory(offsetHistory),
+		windows:         newConsumerWindows(conf.LagWindowSize),
+		commits:         newCommitTracker(),
+		states:          newGroupStateTracker(),
+		rates:           newRateTracker(),
+		groupTopics:     make(map[string][]*topicPattern),
+		includeInternal: conf.IncludeInternalTopics,
+		committedTopics: conf.CommittedTopics,
+		topicScans:      make(map[string]*topicScan),
+		refreshMetadata: conf.CommittedTopics || hasTopicWildcards(topics),
+		uncommittedLag:  conf.UncommittedLag,
+		lagEvents:       conf.LagEvents,
+		lagThreshold:    conf.LagThreshold,
+		partitionEvents: conf.PartitionEvents,
+
+		brokerConcurrency: conf.BrokerConcurrency,
+		brokerTimeout:     brokerTimeout,
+		retryMax:          conf.Retry.Max,
+		retryBackoff:      retryBackoff,
+	}
+
+	switch c.uncommittedLag {
+	case "":
+		c.uncommittedLag = uncommittedLagLogStart
+	case uncommittedLagLogStart, uncommittedLagLogEnd, uncommittedLagNone:
+	default:
+		return nil, fmt.Errorf("Invalid uncommitted_lag %q", c.uncommittedLag)
+	}
+
+	switch c.lagEvents {
+	case "":
+		c.lagEvents = lagEventsPartitions
+	case lagEventsPartitions, lagEventsRollups, lagEventsBoth:
+	default:
+		return nil, fmt.Errorf("Invalid lag_events %q", c.lagEvents)
+	}
+
+	saramaConfig, err := newSaramaConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.kafkaVersion = saramaConfig.Version
+
+	// Brokers before 0.10 close the connection on ApiVersions, so request
+	// versions are only negotiated when the brokers are known to be newer.
+	if saramaConfig.Version.IsAtLeast(sarama.V0_10_0_0) {
+		c.versions = newAPIVersions()
+	}
+
+	switch conf.IsolationLevel {
+	case "", isolationLevelReadUncommitted:
+	case isolationLevelReadCommitted:
+		if !saramaConfig.Version.IsAtLeast(sarama.V0_11_0_0) {
+			return nil, errors.New("isolation_level read_committed requires kafka_version 0.11.0 or later")
+		}
+		c.isolationLevel = sarama.ReadCommitted
+	default:
+		return nil, fmt.Errorf("Invalid isolation_level %q", conf.IsolationLevel)
+	}
+
+	if conf.GroupDiscovery.Enabled && !saramaConfig.Version.IsAtLeast(sarama.V0_9_0_0) {
+		return nil, errors.New("group_discovery requires kafka_version 0.9.0 or later")
+	}
+
+	if conf.TimestampLag.Enabled {
+		if c.versions == nil {
+			return nil, errors.New("timestamp_lag requires kafka_version 0.10.0 or later")
+		}
+		if conf.TimestampLag.MaxFetches <= 0 {
+			conf.TimestampLag.MaxFetches = 100
+		}
+		c.timestamps = newTimestampCache(conf.TimestampLag.MaxFetches)
+	}
+
+	useZookeeper := false
+	for _, group := range groups {
+		switch group.OffsetStorage {
+		case "", offsetStorageKafka:
+		case offsetStorageZookeeper, offsetStorageBoth:
+			useZookeeper = true
+		default:
+			return nil, fmt.Errorf("Invalid offset_storage %q for group %s", group.OffsetStorage, group.Name)
+		}
+
+		if len(group.Topics) == 0 {
+			continue
+		}
+
+		patterns, err := parseTopicPatterns(group.Topics)
+		if err != nil {
+			return nil, err
+		}
+		c.groupTopics[group.Name] = patterns
+		c.refreshMetadata = c.refreshMetadata || hasTopicWildcards(patterns)
+	}
+
+	if useZookeeper {
+		if len(conf.Zookeeper.Hosts) == 0 {
+			return nil, errors.New("zookeeper.hosts is required to read offsets from zookeeper")
+		}
+		if conf.Zookeeper.Timeout == "" {
+			conf.Zookeeper.Timeout = "10s"
+		}
+
+		timeout, err := time.ParseDuration(conf.Zookeeper.Timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		c.zookeeper, err = NewZookeeperClient(conf.Zookeeper.Hosts, timeout, conf.Zookeeper.Chroot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
-	client, err := sarama.NewClient(hosts, sarama.NewConfig())
+	c.client, err = sarama.NewClient(conf.Hosts, saramaConfig)
 	if err != nil {
+		if c.zookeeper != nil {
+			c.zookeeper.Close()
+		}
 		return nil, err
 	}
 
-	return &KafkaClient{client: client, group: group, topics: topics}, nil
+	if conf.GroupDiscovery.Enabled {
+		c.discovery, err = newGroupDiscovery(c.client, saramaConfig, &conf.GroupDiscovery)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if conf.ConsumeOffsetsTopic {
+		c.offsetsTopic, err = newOffsetsTopicCollector(c.client)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func newSaramaConfig(conf *config.KafkabeatConfig) (*sarama.Config, error) {
+	saramaConfig := sarama.NewConfig()
+	// Group membership requests need 0.9. Newer versions are only used when
+	// set, brokers before 0.10 close the connection on ApiVersions.
+	saramaConfig.Version = sarama.V0_9_0_0
+
+	saramaConfig.ClientID = "kafkabeat"
+	if conf.ClientID != "" {
+		saramaConfig.ClientID = conf.ClientID
+	}
+
+	if conf.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(conf.KafkaVersion)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid kafka_version %q", conf.KafkaVersion)
+		}
+		saramaConfig.Version = version
+	} else if conf.SASL.Mechanism != "" || conf.SASL.Username != "" {
+		saramaConfig.Version = sarama.V1_0_0_0
+	}
+
+	if conf.DialTimeout != "" {
+		timeout, err := time.ParseDuration(conf.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Net.DialTimeout = timeout
+	}
+	if conf.ReadTimeout != "" {
+		timeout, err := time.ParseDuration(conf.ReadTimeout)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Net.ReadTimeout = timeout
+	}
+
+	if conf.Metadata.RefreshFrequency != "" {
+		frequency, err := time.ParseDuration(conf.Metadata.RefreshFrequency)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Metadata.RefreshFrequency = frequency
+	}
+	if conf.Metadata.Full != nil {
+		saramaConfig.Metadata.Full = *conf.Metadata.Full
+	}
+
+	if conf.SSL.Enabled {
+		tlsConfig, err := newTLSConfig(&conf.SSL)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	if conf.SASL.Mechanism != "" || conf.SASL.Username != "" {
+		if err := configureSASL(saramaConfig, &conf.SASL); err != nil {
+			return nil, err
+		}
+	}
+
+	return saramaConfig, nil
 }
 
 func (c *KafkaClient) Close() error {
+	if c.zookeeper != nil {
+		c.zookeeper.Close()
+	}
+	if c.offsetsTopic != nil {
+		if err := c.offsetsTopic.Close(); err != nil {
+			logp.Err("Failed to close %s consumer: %v", offsetsTopic, err)
+		}
+	}
 	return c.client.Close()
 }
 
 func (c *KafkaClient) GetOffsetEvents() []common.MapStr {
 	var events []common.MapStr
 
-	offsets, err := c.fetchOffsets()
-	if err != nil {
-		logp.Err("Failed to read kafka status: %v", err)
-		return events
+	snapshot := c.fetchOffsets()
+	offsets := snapshot.offsets
+	if c.timestamps != nil {
+		c.sampleTimestampLag(offsets)
 	}
 
+	now := time.Now()
 	for _, o := range offsets {
+		if o.Err != nil {
+			continue
+		}
+
+		c.history.add(o.Topic, o.Partition, o.HighWatermark, now)
+		c.logStarts.add(o.Topic, o.Partition, o.LogStartOffset, now)
+		if !o.Committed {
+			continue
+		}
+
+		// Commits missing from __consumer_offsets, like those of groups
+		// storing offsets in zookeeper, are timed by polling.
+		key := groupPartitionKey{o.Group, o.Topic, o.Partition}
+		if o.CommitTimestamp.IsZero() {
+			o.CommitTimestamp = c.commits.observe(key, o.ConsumerOffset, now)
+		} else {
+			c.windows.addCommit(key, o.CommitTimestamp)
+		}
+
+		c.windows.add(key, consumerSample{
+			Timestamp:      now,
+			ConsumerOffset: o.ConsumerOffset,
+			BrokerOffset:   o.BrokerOffset,
+		})
+	}
+	c.history.prune(now)
+	c.logStarts.prune(now)
+	c.windows.prune(now.Add(-c.history.retention))
+	c.commits.prune(now.Add(-c.history.retention))
+
+	var rebalances []common.MapStr
+	for _, g := range snapshot.groups {
+		if event := c.states.observe(g, now); event != nil {
+			rebalances = append(rebalances, event)
+		}
+	}
+	c.states.prune(now.Add(-c.history.retention))
+	c.rates.prune(now.Add(-c.history.retention))
+
+	var groups []*groupStatus
+	for _, o := range offsets {
+		if o.Err != nil {
+			if c.lagEvents != lagEventsRollups {
+				events = append(events, common.MapStr{
+					"@timestamp": common.Time(now),
+					"type":       "offset",
+					"offset":     getErrorEvent(o),
+				})
+			}
+			continue
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].group != o.Group {
+			groups = append(groups, &groupStatus{group: o.Group})
+		}
+
 		offset := getOffsetEvent(o)
+		rates := c.rates.observe(o, now)
+		rates.addTo(offset)
+
+		eta := estimateLagETA(o, rates, c.lagThreshold)
+		eta.addTo(offset)
+		if o.HasLag {
+			groups[len(groups)-1].addETA(eta)
+		}
+
+		status := statusOK
+		if o.Committed {
+			status = c.windows.status(groupPartitionKey{o.Group, o.Topic, o.Partition}, now)
+			offset["status"] = status
+
+			if lag, ok := c.history.lagSeconds(o.Topic, o.Partition, o.ConsumerOffset, now); ok {
+				offset["lag_seconds"] = lag
+			}
+
+			offset["consumer_behind_log_start"] = o.ConsumerOffset < o.LogStartOffset
+			if eta, ok := c.retentionETA(o, now); ok {
+				offset["retention_eta_seconds"] = eta
+			}
+		}
+		groups[len(groups)-1].add(o, status)
+
+		if !o.CommitTimestamp.IsZero() {
+			offset["last_commit_timestamp"] = common.Time(o.CommitTimestamp)
+			offset["commit_age_seconds"] = now.Sub(o.CommitTimestamp).Seconds()
+		}
+
+		if c.lagEvents == lagEventsRollups {
+			continue
+		}
 
 		event := common.MapStr{
-			"@timestamp": common.Time(time.Now()),
+			"@timestamp": common.Time(now),
 			"type":       "offset",
 			"offset":     offset,
 		}
@@ -73,18 +551,141 @@ func (c *KafkaClient) GetOffsetEvents() []common.MapStr {
 		events = append(events, event)
 	}
 
+	if c.lagEvents != lagEventsPartitions {
+		groupLags, topicLags := lagRollups(offsets)
+		for _, r := range topicLags {
+			events = append(events, common.MapStr{
+				"@timestamp": common.Time(now),
+				"type":       "topic_lag",
+				"topic_lag":  r.event(),
+			})
+		}
+		for _, r := range groupLags {
+			events = append(events, common.MapStr{
+				"@timestamp": common.Time(now),
+				"type":       "group_lag",
+				"group_lag":  r.event(),
+			})
+		}
+	}
+
+	for _, g := range groups {
+		events = append(events, common.MapStr{
+			"@timestamp":   common.Time(now),
+			"type":         "group_status",
+			"group_status": g.event(),
+		})
+	}
+
+	for _, g := range snapshot.groups {
+		events = append(events, common.MapStr{
+			"@timestamp": common.Time(now),
+			"type":       "group",
+			"group":      c.states.event(g, now),
+		})
+	}
+
+	for _, r := range rebalances {
+		events = append(events, common.MapStr{
+			"@timestamp":      common.Time(now),
+			"type":            "group_rebalance",
+			"group_rebalance": r,
+		})
+	}
+
+	for _, b := range snapshot.brokers {
+		events = append(events, common.MapStr{
+			"@timestamp": common.Time(now),
+			"type":       "broker",
+			"broker":     b.event(),
+		})
+	}
+
+	if snapshot.clusterErr != nil {
+		events = append(events, common.MapStr{
+			"@timestamp": common.Time(now),
+			"type":       "cluster",
+			"cluster":    common.MapStr{"error": errorFields(snapshot.clusterErr)},
+		})
+	}
+
+	if c.partitionEvents {
+		events = append(events, c.getPartitionEvents(partitionsOf(offsets), now)...)
+	}
+
 	return events
 }
 
+func (c *KafkaClient) retentionETA(o *Offset, now time.Time) (float64, bool) {
+	if o.ConsumerOffset < o.LogStartOffset {
+		return 0, true
+	}
+
+	deleteRate, ok := c.logStarts.rate(o.Topic, o.Partition, now)
+	if !ok {
+		return 0, false
+	}
+
+	consumeRate, _ := c.windows.consumeRate(groupPartitionKey{o.Group, o.Topic, o.Partition})
+	return retentionETA(o, deleteRate, consumeRate)
+}
+
 func getOffsetEvent(o *Offset) common.MapStr {
-	return common.MapStr{
-		"group":           o.Group,
-		"topic":           o.Topic,
-		"partition":       o.Partition,
-		"consumer_offset": o.ConsumerOffset,
-		"broker_offset":   o.BrokerOffset,
-		"lag":             o.BrokerOffset - o.ConsumerOffset,
+	event := common.MapStr{
+		"group":             o.Group,
+		"topic":             o.Topic,
+		"partition":         o.Partition,
+		"committed":         o.Committed,
+		"broker_offset":     o.BrokerOffset,
+		"log_start_offset":  o.LogStartOffset,
+		"retained_messages": positiveNum(o.HighWatermark - o.LogStartOffset),
+	}
+	if o.Committed {
+		event["consumer_offset"] = o.ConsumerOffset
+	}
+	if o.HasLag {
+		event["lag"] = o.Lag
+	}
+	if o.HasLastStable {
+		event["last_stable_offset"] = o.LastStable
+		event["hwm_lso_gap"] = positiveNum(o.BrokerOffset - o.LastStable)
+	}
+	if o.HasLagCommitted {
+		event["lag_committed"] = o.LagCommitted
 	}
+	if o.HasLagMs {
+		event["lag_ms"] = o.LagMs
+	}
+	if o.Owner != nil {
+		event["member_id"] = o.Owner.MemberID
+		event["client_id"] = o.Owner.ClientID
+		event["client_host"] = o.Owner.ClientHost
+	}
+	if o.OwnersKnown {
+		event["unowned"] = o.Owner == nil && o.Lag > 0
+	}
+	return event
+}
+
+func getErrorEvent(o *Offset) common.MapStr {
+	event := common.MapStr{
+		"group": o.Group,
+		"topic": o.Topic,
+		"error": errorFields(o.Err),
+	}
+	// Topics whose partitions couldn't be read have no partition.
+	if o.Partition >= 0 {
+		event["partition"] = o.Partition
+	}
+	return event
+}
+
+func errorFields(err error) common.MapStr {
+	fields := common.MapStr{"message": err.Error()}
+	if kerr, ok := err.(sarama.KError); ok {
+		fields["code"] = int16(kerr)
+	}
+	return fields
 }
 
 func positiveNum(o int64) int64 {
@@ -94,59 +695,399 @@ func positiveNum(o int64) int64 {
 	return o
 }
 
-func (c *KafkaClient) fetchOffsets() ([]*Offset, error) {
-	tp, err := c.topicPartitions()
+// offsetSnapshot is everything read from the cluster in one period.
+type offsetSnapshot struct {
+	offsets []*Offset
+	groups  []*groupMetadata
+	brokers []*brokerResponse
+	// clusterErr is set when the metadata couldn't be refreshed and the
+	// topics were resolved against the cached metadata.
+	clusterErr error
+}
+
+func (c *KafkaClient) fetchOffsets() *offsetSnapshot {
+	snapshot := &offsetSnapshot{}
+
+	clusterTopics, err := c.clusterTopics()
 	if err != nil {
-		return nil, err
+		logp.Warn("Failed to refresh metadata, using the cached topics: %v", err)
+		snapshot.clusterErr = err
+		clusterTopics, _ = c.client.Topics()
 	}
 
-	co, err := c.fetchConsumerOffsets(tp)
-	if err != nil {
-		return nil, err
+	if c.offsetsTopic != nil && !c.offsetsTopic.ready() {
+		c.offsetsTopic.checkPending()
 	}
 
-	bo, err := c.fetchBrokerOffsets(tp)
-	if err != nil {
+	if c.committedTopics {
+		c.pruneTopicScans(time.Now())
+	}
+
+	groups := c.consumerGroups()
+	groupPartitions := make(map[string]topicPartitions)
+	groupOffsets := make(map[string]partitionOffsets)
+	groupErrors := make(map[string]partitionErrors)
+	groupTopicErrors := make(map[string]topicErrors)
+	groupOwners := make(map[string]partitionOwners)
+	allPartitions := make(topicPartitions)
+
+	for _, group := range groups {
+		tp, co, errs, terrs := c.fetchGroupOffsets(group, clusterTopics)
+		groupPartitions[group.Name] = tp
+		groupOffsets[group.Name] = co
+		groupErrors[group.Name] = errs
+		groupTopicErrors[group.Name] = terrs
+
+		// Legacy consumers storing offsets in zookeeper don't join groups
+		// on the brokers, and brokers before 0.9 can't describe groups.
+		if group.OffsetStorage != offsetStorageZookeeper && c.kafkaVersion.IsAtLeast(sarama.V0_9_0_0) {
+			metadata, err := c.describeGroup(group.Name)
+			if err != nil && c.offsetsTopic != nil {
+				logp.Debug("kafkabeat", "Failed to describe group %s, reading it from %s: %v", group.Name, offsetsTopic, err)
+				metadata, err = c.offsetsTopic.describeGroup(c.client, group.Name)
+			}
+			if err != nil {
+				logp.Warn("Failed to describe group %s: %v", group.Name, err)
+			} else {
+				snapshot.groups = append(snapshot.groups, metadata)
+
+				owners, err := metadata.partitionOwners()
+				if err != nil {
+					logp.Warn("Failed to read assignments of group %s: %v", group.Name, err)
+				} else {
+					groupOwners[group.Name] = owners
+				}
+			}
+		}
+
+		for topic, partitions := range tp {
+			allPartitions[topic] = partitions
+		}
+	}
+
+	bo, boErrs, boResponses := c.fetchBrokerOffsets(allPartitions)
+	lo, loErrs, loResponses := c.fetchLogStartOffsets(allPartitions)
+	snapshot.brokers = append(boResponses, loResponses...)
+
+	// The last stable offsets are optional, partitions missing them are
+	// still reported with their high watermark lag.
+	var lso partitionOffsets
+	if c.isolationLevel == sarama.ReadCommitted {
+		var lsoErrs partitionErrors
+		var lsoResponses []*brokerResponse
+		lso, lsoErrs, lsoResponses = c.fetchLastStableOffsets(allPartitions)
+		snapshot.brokers = append(snapshot.brokers, lsoResponses...)
+		if len(lsoErrs) > 0 {
+			logp.Warn("Failed to fetch last stable offsets of %d partitions", len(lsoErrs))
+		}
+	}
+	for _, group := range groups {
+		tp := groupPartitions[group.Name]
+		co := groupOffsets[group.Name]
+		errs := groupErrors[group.Name]
+		terrs := groupTopicErrors[group.Name]
+		owners, ownersKnown := groupOwners[group.Name]
+
+		for _, topic := range terrs.topicsWith(tp) {
+			if err, ok := terrs[topic]; ok {
+				snapshot.offsets = append(snapshot.offsets, &Offset{
+					Group:     group.Name,
+					Topic:     topic,
+					Partition: -1,
+					Err:       err,
+				})
+				continue
+			}
+
+			for _, partition := range tp[topic] {
+				key := partitionKey{topic, partition}
+				if err := firstError(errs[key], boErrs[key], loErrs[key]); err != nil {
+					snapshot.offsets = append(snapshot.offsets, &Offset{
+						Group:     group.Name,
+						Topic:     topic,
+						Partition: partition,
+						Err:       err,
+					})
+					continue
+				}
+
+				consumerOffset, committed := co[topic][partition]
+				if consumerOffset < 0 {
+					committed = false
+				}
+
+				offset := &Offset{
+					Group:          group.Name,
+					Topic:          topic,
+					Partition:      partition,
+					Committed:      committed,
+					ConsumerOffset: consumerOffset,
+					BrokerOffset:   positiveNum(bo[topic][partition]),
+					HighWatermark:  bo[topic][partition] + 1,
+					LogStartOffset: lo[topic][partition],
+					Owner:          owners[key],
+					OwnersKnown:    ownersKnown,
+				}
+				if lastStable, ok := lso[topic][partition]; ok {
+					offset.LastStable, offset.HasLastStable = positiveNum(lastStable), true
+				}
+				c.computeLag(offset)
+				if c.offsetsTopic != nil && group.OffsetStorage != offsetStorageZookeeper {
+					offset.CommitTimestamp, _ = c.offsetsTopic.commitTimestamp(group.Name, topic, partition)
+				}
+				snapshot.offsets = append(snapshot.offsets, offset)
+			}
+		}
+	}
+	return snapshot
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *KafkaClient) computeLag(o *Offset) {
+	o.Lag, o.HasLag = c.lagTo(o, o.BrokerOffset)
+	if o.HasLastStable {
+		o.LagCommitted, o.HasLagCommitted = c.lagTo(o, o.LastStable)
+	}
+}
+
+// lagTo is the lag of the consumer behind the end offset, the high watermark
+// or the last stable offset.
+func (c *KafkaClient) lagTo(o *Offset, end int64) (int64, bool) {
+	if o.Committed {
+		return end - o.ConsumerOffset, true
+	}
+
+	switch c.uncommittedLag {
+	case uncommittedLagLogStart:
+		return positiveNum(end - o.LogStartOffset), true
+	case uncommittedLagLogEnd:
+		return 0, true
+	}
+	return 0, false
+}
+
+func (c *KafkaClient) clusterTopics() ([]string, error) {
+	if !c.refreshMetadata {
+		return nil, nil
+	}
+
+	if err := c.client.RefreshMetadata(); err != nil {
 		return nil, err
 	}
+	return c.client.Topics()
+}
 
-	var offsets []*Offset
-	for topic, partitions := range tp {
-		for _, partition := range partitions {
-			offset := &Offset{
-				Group:          c.group,
-				Topic:          topic,
-				Partition:      partition,
-				ConsumerOffset: positiveNum(co[topic][partition]),
-				BrokerOffset:   positiveNum(bo[topic][partition]),
+func (c *KafkaClient) fetchGroupOffsets(group config.ConsumerGroupConfig, clusterTopics []string) (topicPartitions, partitionOffsets, partitionErrors, topicErrors) {
+	patterns, ok := c.groupTopics[group.Name]
+	if !ok {
+		patterns = c.topics
+	}
+	topics := resolveTopics(patterns, clusterTopics, c.includeInternal)
+
+	if !c.committedTopics {
+		tp, terrs := c.topicPartitions(topics)
+		co, errs := c.groupConsumerOffsets(group, tp)
+		return tp, co, errs, terrs
+	}
+
+	// Ask for the topics the group may have committed offsets for and keep
+	// the ones it has, along with the configured topics.
+	now := time.Now()
+	candidates, scan := c.committedTopicCandidates(group, clusterTopics, now)
+	candidates = append(candidates, topics...)
+
+	tp, terrs := c.topicPartitions(candidates)
+	co, errs := c.groupConsumerOffsets(group, tp)
+
+	configured := make(map[string]bool)
+	for _, topic := range topics {
+		configured[topic] = true
+	}
+
+	if scan && len(errs) == 0 {
+		s := &topicScan{scanned: now}
+		for _, topic := range tp.topics() {
+			if co.hasCommitted(topic) {
+				s.topics = append(s.topics, topic)
 			}
-			offsets = append(offsets, offset)
 		}
+		c.topicScans[group.Name] = s
 	}
-	return offsets, nil
+
+	for topic := range tp {
+		if !configured[topic] && !co.hasCommitted(topic) {
+			delete(tp, topic)
+		}
+	}
+	// Whether the group committed to the topics that failed is unknown,
+	// only the configured ones are reported.
+	for topic := range terrs {
+		if !configured[topic] {
+			delete(terrs, topic)
+		}
+	}
+	return tp, co, errs, terrs
+}
+
+// groupConsumerOffsets reads the committed offsets of a group, turning a
+// failure of the whole request into an error on every partition.
+func (c *KafkaClient) groupConsumerOffsets(group config.ConsumerGroupConfig, tp topicPartitions) (partitionOffsets, partitionErrors) {
+	co, errs, err := c.consumerOffsets(group, tp)
+	if err != nil {
+		logp.Err("Failed to fetch offsets for group %s: %v", group.Name, err)
+		co, errs = make(partitionOffsets), make(partitionErrors)
+		errs.addAll(tp, err)
+	}
+	return co, errs
+}
+
+func (c *KafkaClient) consumerGroups() []config.ConsumerGroupConfig {
+	if c.discovery == nil {
+		return c.groups
+	}
+
+	groups := append([]config.ConsumerGroupConfig(nil), c.groups...)
+	configured := make(map[string]bool)
+	for _, group := range c.groups {
+		configured[group.Name] = true
+	}
+
+	for _, name := range c.discovery.Groups() {
+		if !configured[name] {
+			groups = append(groups, config.ConsumerGroupConfig{Name: name})
+		}
+	}
+	return groups
 }
 
-func (c *KafkaClient) topicPartitions() (topicPartitions, error) {
+func (c *KafkaClient) topicPartitions(topics []string) (topicPartitions, topicErrors) {
 	topicPartitions := make(topicPartitions)
-	for _, topic := range c.topics {
+	errs := make(topicErrors)
+	for _, topic := range topics {
+		if _, ok := topicPartitions[topic]; ok {
+			continue
+		}
+		if _, ok := errs[topic]; ok {
+			continue
+		}
+
 		partitions, err := c.client.Partitions(topic)
 		if err != nil {
-			return nil, err
+			logp.Warn("Failed to read partitions of topic %s: %v", topic, err)
+			errs[topic] = err
+			continue
 		}
 		topicPartitions[topic] = partitions
 	}
-	return topicPartitions, nil
+	return topicPartitions, errs
 }
 
-func (c *KafkaClient) fetchConsumerOffsets(tp topicPartitions) (partitionOffsets, error) {
-	broker, err := c.client.Coordinator(c.group)
+func (c *KafkaClient) consumerOffsets(group config.ConsumerGroupConfig, tp topicPartitions) (partitionOffsets, partitionErrors, error) {
+	switch group.OffsetStorage {
+	case offsetStorageZookeeper:
+		zo, err := c.zookeeper.fetchConsumerOffsets(group.Name, tp)
+		return zo, nil, err
+	case offsetStorageBoth:
+		zo, zerr := c.zookeeper.fetchConsumerOffsets(group.Name, tp)
+		ko, kerrs, kerr := c.kafkaConsumerOffsets(group.Name, tp)
+		switch {
+		case zerr != nil && kerr != nil:
+			return nil, nil, kerr
+		case zerr != nil:
+			logp.Warn("Failed to read zookeeper offsets for group %s: %v", group.Name, zerr)
+			return ko, kerrs, nil
+		case kerr != nil:
+			logp.Warn("Failed to read kafka offsets for group %s: %v", group.Name, kerr)
+			kerrs = make(partitionErrors)
+			kerrs.addAll(tp, kerr)
+			return zo, kerrs.missingFrom(zo), nil
+		}
+		return maxOffsets(zo, ko), kerrs.missingFrom(zo), nil
+	default:
+		return c.kafkaConsumerOffsets(group.Name, tp)
+	}
+}
+
+func (c *KafkaClient) kafkaConsumerOffsets(group string, tp topicPartitions) (partitionOffsets, partitionErrors, error) {
+	if c.offsetsTopic != nil && c.offsetsTopic.ready() {
+		return c.offsetsTopic.fetchConsumerOffsets(group, tp), nil, nil
+	}
+	return c.fetchConsumerOffsets(group, tp)
+}
+
+// maxOffsets merges the offsets of a group committing to both storages,
+// keeping the most recent one.
+func maxOffsets(a, b partitionOffsets) partitionOffsets {
+	offsets := make(partitionOffsets)
+	for _, po := range []partitionOffsets{a, b} {
+		for topic, partitions := range po {
+			if offsets[topic] == nil {
+				offsets[topic] = make(partitionOffset)
+			}
+			for partition, offset := range partitions {
+				if current, ok := offsets[topic][partition]; !ok || offset > current {
+					offsets[topic][partition] = offset
+				}
+			}
+		}
+	}
+	return offsets
+}
+
+// fetchConsumerOffsets asks the coordinator of the group for its offsets,
+// retrying the partitions that failed because the coordinator moved.
+func (c *KafkaClient) fetchConsumerOffsets(group string, tp topicPartitions) (partitionOffsets, partitionErrors, error) {
+	offsets := make(partitionOffsets)
+	errs := make(partitionErrors)
+
+	for attempt := 0; ; attempt++ {
+		retry := make(topicPartitions)
+
+		attemptErrs, err := c.requestConsumerOffsets(group, tp, offsets)
+		if err != nil {
+			if attempt >= c.retryMax || !isRetriableCoordinatorError(err) {
+				return nil, nil, err
+			}
+			retry = tp
+		}
+
+		for key, err := range attemptErrs {
+			if attempt < c.retryMax && isRetriableCoordinatorError(err) {
+				retry[key.topic] = append(retry[key.topic], key.partition)
+				continue
+			}
+			errs[key] = err
+		}
+		if len(retry) == 0 {
+			return offsets, errs, nil
+		}
+
+		logp.Debug("kafkabeat", "Retrying offsets of group %s after coordinator error", group)
+		time.Sleep(c.retryBackoff)
+		if err := c.client.RefreshCoordinator(group); err != nil {
+			logp.Warn("Failed to refresh coordinator of group %s: %v", group, err)
+		}
+		tp = retry
+	}
+}
+
+func (c *KafkaClient) requestConsumerOffsets(group string, tp topicPartitions, offsets partitionOffsets) (partitionErrors, error) {
+	broker, err := c.client.Coordinator(group)
 	if err != nil {
 		return nil, err
 	}
 
 	request := &sarama.OffsetFetchRequest{
-		Version:       1,
-		ConsumerGroup: c.group,
+		Version:       c.requestVersion(broker, apiKeyOffsetFetch),
+		ConsumerGroup: group,
 	}
 	for topic, partitions := range tp {
 		for _, p := range partitions {
@@ -156,10 +1097,16 @@ func (c *KafkaClient) fetchConsumerOffsets(tp topicPartitions) (partitionOffsets
 
 	response, err := broker.FetchOffset(request)
 	if err != nil {
+		c.forgetVersions(broker)
 		return nil, err
 	}
 
-	offsets := make(partitionOffsets)
+	// From version 2 on, errors of the whole group are reported once.
+	errs := make(partitionErrors)
+	if response.Err != sarama.ErrNoError {
+		errs.addAll(tp, response.Err)
+		return errs, nil
+	}
 	for topic, partitions := range tp {
 		for _, partition := range partitions {
 			block := response.GetBlock(topic, partition)
@@ -167,7 +1114,8 @@ func (c *KafkaClient) fetchConsumerOffsets(tp topicPartitions) (partitionOffsets
 				continue
 			}
 			if block.Err != sarama.ErrNoError {
-				return nil, block.Err
+				errs[partitionKey{topic, partition}] = block.Err
+				continue
 			}
 
 			if offsets[topic] == nil {
@@ -177,63 +1125,156 @@ func (c *KafkaClient) fetchConsumerOffsets(tp topicPartitions) (partitionOffsets
 		}
 	}
 
-	return offsets, nil
+	return errs, nil
 }
 
-func newBrokerOffsetRequest() *brokerOffsetRequest {
+func newBrokerOffsetRequest(at int64, isolation sarama.IsolationLevel) *brokerOffsetRequest {
 	return &brokerOffsetRequest{
+		at:         at,
+		isolation:  isolation,
 		partitions: make(map[string][]int32),
-		request:    &sarama.OffsetRequest{},
+		request:    &sarama.OffsetRequest{IsolationLevel: isolation},
 	}
 }
 
 func (c *brokerOffsetRequest) addBlock(topic string, partition int32) {
-	c.request.AddBlock(topic, partition, sarama.OffsetNewest, 1)
+	c.request.AddBlock(topic, partition, c.at, 1)
 	c.partitions[topic] = append(c.partitions[topic], partition)
 }
 
-func (c *KafkaClient) fetchBrokerOffsets(tp topicPartitions) (partitionOffsets, error) {
+func (c *KafkaClient) fetchBrokerOffsets(tp topicPartitions) (partitionOffsets, partitionErrors, []*brokerResponse) {
+	return c.fetchLastOffsets(tp, sarama.ReadUncommitted)
+}
+
+// fetchLastStableOffsets reads the offsets a read_committed consumer can go
+// up to, before the first message of the oldest open transaction.
+func (c *KafkaClient) fetchLastStableOffsets(tp topicPartitions) (partitionOffsets, partitionErrors, []*brokerResponse) {
+	return c.fetchLastOffsets(tp, sarama.ReadCommitted)
+}
+
+func (c *KafkaClient) fetchLastOffsets(tp topicPartitions, isolation sarama.IsolationLevel) (partitionOffsets, partitionErrors, []*brokerResponse) {
+	offsets, errs, responses := c.fetchAvailableOffsets(tp, sarama.OffsetNewest, isolation)
+
+	for _, partitions := range offsets {
+		for partition := range partitions {
+			partitions[partition]--
+		}
+	}
+	return offsets, errs, responses
+}
+
+func (c *KafkaClient) fetchLogStartOffsets(tp topicPartitions) (partitionOffsets, partitionErrors, []*brokerResponse) {
+	return c.fetchAvailableOffsets(tp, sarama.OffsetOldest, sarama.ReadUncommitted)
+}
+
+// fetchAvailableOffsets asks the partition leaders for their offsets,
+// refreshing the metadata and retrying the partitions whose leader moved.
+func (c *KafkaClient) fetchAvailableOffsets(tp topicPartitions, at int64, isolation sarama.IsolationLevel) (partitionOffsets, partitionErrors, []*brokerResponse) {
+	offsets := make(partitionOffsets)
+	errs := make(partitionErrors)
+	var responses []*brokerResponse
+
+	for attempt := 0; ; attempt++ {
+		attemptErrs, attemptResponses := c.requestAvailableOffsets(tp, at, isolation, offsets)
+		responses = append(responses, attemptResponses...)
+
+		retry := make(topicPartitions)
+		for key, err := range attemptErrs {
+			if attempt < c.retryMax && isRetriableLeaderError(err) {
+				retry[key.topic] = append(retry[key.topic], key.partition)
+				continue
+			}
+			errs[key] = err
+		}
+		if len(retry) == 0 {
+			return offsets, errs, responses
+		}
+
+		logp.Debug("kafkabeat", "Retrying offsets of topics %v after leader error", retry.topics())
+		time.Sleep(c.retryBackoff)
+		if err := c.client.RefreshMetadata(retry.topics()...); err != nil {
+			logp.Warn("Failed to refresh metadata: %v", err)
+		}
+		tp = retry
+	}
+}
+
+func (c *KafkaClient) requestAvailableOffsets(tp topicPartitions, at int64, isolation sarama.IsolationLevel, offsets partitionOffsets) (partitionErrors, []*brokerResponse) {
 	requests := make(map[*sarama.Broker]*brokerOffsetRequest)
+	errs := make(partitionErrors)
 
 	for topic, partitions := range tp {
 		for _, partition := range partitions {
 			broker, err := c.client.Leader(topic, partition)
 			if err != nil {
-				return nil, err
+				errs[partitionKey{topic, partition}] = err
+				continue
 			}
 			if _, ok := requests[broker]; !ok {
-				requests[broker] = newBrokerOffsetRequest()
+				requests[broker] = newBrokerOffsetRequest(at, isolation)
 			}
 
 			requests[broker].addBlock(topic, partition)
 		}
 	}
 
-	offsets := make(partitionOffsets)
+	responses := c.sendOffsetRequests(requests)
 
-	for broker, r := range requests {
-		response, err := broker.GetAvailableOffsets(r.request)
-		if err != nil {
-			return nil, err
+	for _, res := range responses {
+		if res.err != nil {
+			logp.Warn("Failed to fetch offsets from broker %s: %v", res.broker.Addr(), res.err)
+			errs.addAll(res.request.partitions, res.err)
+			continue
 		}
 
-		for topic, partitions := range r.partitions {
+		for topic, partitions := range res.request.partitions {
 			for _, partition := range partitions {
-				block := response.GetBlock(topic, partition)
+				block := res.response.GetBlock(topic, partition)
 				if block == nil {
-					return nil, sarama.ErrIncompleteResponse
+					errs[partitionKey{topic, partition}] = sarama.ErrIncompleteResponse
+					continue
 				}
 				if block.Err != sarama.ErrNoError {
-					return nil, block.Err
+					errs[partitionKey{topic, partition}] = block.Err
+					continue
 				}
 
 				if offsets[topic] == nil {
 					offsets[topic] = make(partitionOffset)
 				}
-				offsets[topic][partition] = block.Offsets[0] - 1
+				offsets[topic][partition] = blockOffset(res.response, block)
 			}
 		}
 	}
 
-	return offsets, nil
+	return errs, responses
+}
+
+// blockOffset is the offset of a ListOffsets response, returned in a list
+// before version 1.
+func blockOffset(response *sarama.OffsetResponse, block *sarama.OffsetResponseBlock) int64 {
+	if response.Version >= 1 || len(block.Offsets) == 0 {
+		return block.Offset
+	}
+	return block.Offsets[0]
+}
+
+func isRetriableLeaderError(err error) bool {
+	switch err {
+	case sarama.ErrNotLeaderForPartition, sarama.ErrLeaderNotAvailable,
+		sarama.ErrUnknownTopicOrPartition, sarama.ErrFencedLeaderEpoch:
+		return true
+	default:
+		return false
+	}
+}
+
+func isRetriableCoordinatorError(err error) bool {
+	switch err {
+	case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable,
+		sarama.ErrOffsetsLoadInProgress:
+		return true
+	default:
+		return false
+	}
 }
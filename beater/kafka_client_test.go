@@ -3,10 +3,13 @@ package beater
 import (
 	"io"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
 )
 
 func safeClose(t testing.TB, c io.Closer) {
@@ -20,7 +23,11 @@ func TestNewKafkaClient(t *testing.T) {
 	seedBroker := sarama.NewMockBroker(t, 1)
 	seedBroker.Returns(new(sarama.MetadataResponse))
 
-	client, err := NewKafkaClient([]string{seedBroker.Addr()}, "test", []string{"test-topic"})
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,6 +36,67 @@ func TestNewKafkaClient(t *testing.T) {
 	safeClose(t, client)
 }
 
+func TestNewKafkaClientOffsetStorage(t *testing.T) {
+	_, err := NewKafkaClient(&config.KafkabeatConfig{
+		ConsumerGroups: []config.ConsumerGroupConfig{
+			{Name: "test", OffsetStorage: "redis"},
+		},
+	})
+	assert.Error(t, err)
+
+	_, err = NewKafkaClient(&config.KafkabeatConfig{
+		ConsumerGroups: []config.ConsumerGroupConfig{
+			{Name: "test", OffsetStorage: "zookeeper"},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestNewKafkaClientVersionedOptions(t *testing.T) {
+	_, err := NewKafkaClient(&config.KafkabeatConfig{IsolationLevel: "read_committed"})
+	assert.Error(t, err)
+
+	_, err = NewKafkaClient(&config.KafkabeatConfig{KafkaVersion: "0.11.0.0", IsolationLevel: "serializable"})
+	assert.Error(t, err)
+
+	_, err = NewKafkaClient(&config.KafkabeatConfig{TimestampLag: config.TimestampLagConfig{Enabled: true}})
+	assert.Error(t, err)
+
+	_, err = NewKafkaClient(&config.KafkabeatConfig{KafkaVersion: "0.8.2.0", GroupDiscovery: config.GroupDiscoveryConfig{Enabled: true}})
+	assert.Error(t, err)
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	full := false
+	saramaConfig, err := newSaramaConfig(&config.KafkabeatConfig{
+		KafkaVersion: "1.1.0",
+		ClientID:     "monitoring",
+		DialTimeout:  "5s",
+		ReadTimeout:  "1m",
+		Metadata:     config.MetadataConfig{RefreshFrequency: "2m", Full: &full},
+	})
+	assert.NoError(err)
+	assert.True(saramaConfig.Version.IsAtLeast(sarama.V1_0_0_0))
+	assert.Equal("monitoring", saramaConfig.ClientID)
+	assert.Equal(5*time.Second, saramaConfig.Net.DialTimeout)
+	assert.Equal(time.Minute, saramaConfig.Net.ReadTimeout)
+	assert.Equal(2*time.Minute, saramaConfig.Metadata.RefreshFrequency)
+	assert.False(saramaConfig.Metadata.Full)
+
+	saramaConfig, err = newSaramaConfig(&config.KafkabeatConfig{})
+	assert.NoError(err)
+	assert.Equal("kafkabeat", saramaConfig.ClientID)
+	assert.Equal(sarama.V0_9_0_0, saramaConfig.Version)
+
+	_, err = newSaramaConfig(&config.KafkabeatConfig{KafkaVersion: "latest"})
+	assert.Error(err)
+
+	_, err = newSaramaConfig(&config.KafkabeatConfig{DialTimeout: "5"})
+	assert.Error(err)
+}
+
 func TestGetOffsetEvents(t *testing.T) {
 	seedBroker := sarama.NewMockBroker(t, 1)
 	coordinator := sarama.NewMockBroker(t, 2)
@@ -36,7 +104,11 @@ func TestGetOffsetEvents(t *testing.T) {
 
 	initBrokers(seedBroker, coordinator, leader)
 
-	client, err := NewKafkaClient([]string{seedBroker.Addr()}, "test", []string{"test-topic"})
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,6 +124,14 @@ func TestGetOffsetEvents(t *testing.T) {
 	assert.Equal(int64(110), o1["broker_offset"].(int64))
 	assert.Equal(int64(110), o1["consumer_offset"].(int64))
 	assert.Equal(int64(0), o1["lag"].(int64))
+	assert.Equal(true, o1["committed"].(bool))
+	assert.Equal(int64(0), o1["log_start_offset"].(int64))
+	assert.Equal(int64(111), o1["retained_messages"].(int64))
+	assert.Equal(false, o1["consumer_behind_log_start"].(bool))
+	assert.Equal("member-1", o1["member_id"].(string))
+	assert.Equal("client-1", o1["client_id"].(string))
+	assert.Equal("/127.0.0.1", o1["client_host"].(string))
+	assert.Equal(false, o1["unowned"].(bool))
 
 	o2 := events[1]["offset"].(common.MapStr)
 	assert.Equal("test", o2["group"].(string))
@@ -60,6 +140,20 @@ func TestGetOffsetEvents(t *testing.T) {
 	assert.Equal(int64(221), o2["broker_offset"].(int64))
 	assert.Equal(int64(220), o2["consumer_offset"].(int64))
 	assert.Equal(int64(1), o2["lag"].(int64))
+	assert.Equal(int64(21), o2["log_start_offset"].(int64))
+	assert.Equal(int64(201), o2["retained_messages"].(int64))
+	assert.Equal(true, o2["unowned"].(bool))
+	assert.NotContains(o2, "member_id")
+
+	assert.Len(events, 6)
+	for i, request := range []string{"log_end_offsets", "log_start_offsets"} {
+		b := events[4+i]["broker"].(common.MapStr)
+		assert.Equal("broker", events[4+i]["type"])
+		assert.Equal(leader.BrokerID(), b["id"])
+		assert.Equal(request, b["request"])
+		assert.Equal(2, b["partition_count"])
+		assert.NotContains(b, "error")
+	}
 
 	seedBroker.Close()
 	coordinator.Close()
@@ -67,12 +161,12 @@ func TestGetOffsetEvents(t *testing.T) {
 	safeClose(t, client)
 }
 
-func initBrokers(seedBroker, coordinator, leader *sarama.MockBroker) {
-	metadateRes := new(sarama.MetadataResponse)
-	metadateRes.AddBroker(leader.Addr(), leader.BrokerID())
-	metadateRes.AddTopicPartition("test-topic", 0, leader.BrokerID(), nil, nil, sarama.ErrNoError)
-	metadateRes.AddTopicPartition("test-topic", 1, leader.BrokerID(), nil, nil, sarama.ErrNoError)
-	seedBroker.Returns(metadateRes)
+func TestGetOffsetEventsMultipleGroups(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initBrokers(seedBroker, coordinator, leader)
 
 	coordinatorRes := new(sarama.ConsumerMetadataResponse)
 	coordinatorRes.CoordinatorID = coordinator.BrokerID()
@@ -80,11 +174,375 @@ func initBrokers(seedBroker, coordinator, leader *sarama.MockBroker) {
 	coordinatorRes.CoordinatorPort = coordinator.Port()
 	seedBroker.Returns(coordinatorRes)
 
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{
+		Err:      sarama.ErrNoError,
+		Offset:   100,
+		Metadata: "",
+	})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test2", nil))
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts: []string{seedBroker.Addr()},
+		ConsumerGroups: []config.ConsumerGroupConfig{
+			{Name: "test"},
+			{Name: "test2", Topics: []string{"test-topic"}},
+		},
+		Topics: []string{"test-topic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+	assert.Len(events, 10)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal("test", o1["group"].(string))
+	assert.Equal(int64(0), o1["lag"].(int64))
+
+	o3 := events[2]["offset"].(common.MapStr)
+	assert.Equal("test2", o3["group"].(string))
+	assert.Equal(int32(0), o3["partition"].(int32))
+	assert.Equal(int64(100), o3["consumer_offset"].(int64))
+	assert.Equal(int64(10), o3["lag"].(int64))
+	assert.Equal(true, o3["unowned"].(bool))
+
+	o4 := events[3]["offset"].(common.MapStr)
+	assert.Equal(int32(1), o4["partition"].(int32))
+	assert.Equal(false, o4["committed"].(bool))
+	assert.NotContains(o4, "consumer_offset")
+	assert.Equal(int64(200), o4["lag"].(int64))
+
+	assert.Equal("group_status", events[4]["type"])
+	assert.Equal("test", events[4]["group_status"].(common.MapStr)["group"])
+	assert.Equal("group_status", events[5]["type"])
+	assert.Equal("test2", events[5]["group_status"].(common.MapStr)["group"])
+
+	g1 := events[6]["group"].(common.MapStr)
+	assert.Equal("group", events[6]["type"])
+	assert.Equal("test", g1["group"])
+	assert.Equal("Stable", g1["state"])
+	assert.Equal("range", g1["protocol"])
+	assert.Equal(1, g1["member_count"])
+	assert.Equal(coordinator.BrokerID(), g1["coordinator"])
+	assert.Equal("test2", events[7]["group"].(common.MapStr)["group"])
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsPartitionError(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 0, 2)
+
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{
+		Err:    sarama.ErrNoError,
+		Offset: 110,
+	})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{
+		Err:    sarama.ErrUnknownTopicOrPartition,
+		Offset: -1,
+	})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
 	offsetRes := new(sarama.OffsetResponse)
 	offsetRes.AddTopicPartition("test-topic", 0, 111)
 	offsetRes.AddTopicPartition("test-topic", 1, 222)
 	leader.Returns(offsetRes)
 
+	oldestRes := new(sarama.OffsetResponse)
+	oldestRes.AddTopicPartition("test-topic", 0, 0)
+	oldestRes.AddTopicPartition("test-topic", 1, 21)
+	leader.Returns(oldestRes)
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal(int64(110), o1["consumer_offset"].(int64))
+	assert.NotContains(o1, "error")
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal(int32(1), o2["partition"].(int32))
+	assert.NotContains(o2, "lag")
+	assert.Equal(int16(sarama.ErrUnknownTopicOrPartition), o2["error"].(common.MapStr)["code"])
+
+	assert.Equal("group_status", events[2]["type"])
+	assert.Equal(1, events[2]["group_status"].(common.MapStr)["partition_count"])
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsUnknownTopic(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	seedBroker.Returns(metadataResponse(leader, 0, 1))
+
+	// The metadata request for the missing topic is retried.
+	missingRes := new(sarama.MetadataResponse)
+	missingRes.AddBroker(leader.Addr(), leader.BrokerID())
+	missingRes.AddTopic("missing-topic", sarama.ErrUnknownTopicOrPartition)
+	for i := 0; i < 4; i++ {
+		seedBroker.Returns(missingRes)
+	}
+	seedBroker.Returns(coordinatorResponse(coordinator))
+
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	for _, offset := range []int64{111, 0} {
+		offsetRes := new(sarama.OffsetResponse)
+		offsetRes.AddTopicPartition("test-topic", 0, offset)
+		leader.Returns(offsetRes)
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic", "missing-topic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal("missing-topic", o1["topic"])
+	assert.NotContains(o1, "partition")
+	assert.Equal(int16(sarama.ErrUnknownTopicOrPartition), o1["error"].(common.MapStr)["code"])
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal("test-topic", o2["topic"])
+	assert.Equal(int64(110), o2["consumer_offset"].(int64))
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsMetadataRefreshFailed(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	seedBroker.Returns(metadataResponse(leader, 0, 1))
+
+	// Refreshing fails on a topic kafkabeat may not describe, the cached
+	// topics are matched instead.
+	deniedRes := metadataResponse(leader, 0, 1)
+	deniedRes.AddTopic("secret-topic", sarama.ErrTopicAuthorizationFailed)
+	seedBroker.Returns(deniedRes)
+	seedBroker.Returns(coordinatorResponse(coordinator))
+
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	for _, offset := range []int64{111, 0} {
+		offsetRes := new(sarama.OffsetResponse)
+		offsetRes.AddTopicPartition("test-topic", 0, offset)
+		leader.Returns(offsetRes)
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal("test-topic", o1["topic"])
+	assert.Equal(int64(110), o1["consumer_offset"].(int64))
+
+	var cluster common.MapStr
+	for _, event := range events {
+		if event["type"] == "cluster" {
+			cluster = event["cluster"].(common.MapStr)
+		}
+	}
+	if assert.NotNil(cluster) {
+		assert.Equal(int16(sarama.ErrTopicAuthorizationFailed), cluster["error"].(common.MapStr)["code"])
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsLeaderMoved(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	metadateRes := initSeedBroker(seedBroker, coordinator, leader, 0, 2)
+
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	notLeaderRes := &sarama.OffsetResponse{
+		Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+			"test-topic": {
+				0: {Err: sarama.ErrNoError, Offsets: []int64{111}},
+				1: {Err: sarama.ErrNotLeaderForPartition},
+			},
+		},
+	}
+	leader.Returns(notLeaderRes)
+
+	// The retry refreshes the metadata, still pointing at the same leader.
+	seedBroker.Returns(metadateRes)
+
+	retryRes := new(sarama.OffsetResponse)
+	retryRes.AddTopicPartition("test-topic", 1, 222)
+	leader.Returns(retryRes)
+
+	oldestRes := new(sarama.OffsetResponse)
+	oldestRes.AddTopicPartition("test-topic", 0, 0)
+	oldestRes.AddTopicPartition("test-topic", 1, 21)
+	leader.Returns(oldestRes)
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		Retry:         config.RetryConfig{Backoff: "1ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal(int32(1), o2["partition"].(int32))
+	assert.NotContains(o2, "error")
+	assert.Equal(int64(221), o2["broker_offset"].(int64))
+	assert.Equal(int64(1), o2["lag"].(int64))
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestIsRetriableError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isRetriableLeaderError(sarama.ErrNotLeaderForPartition))
+	assert.False(isRetriableLeaderError(sarama.ErrNotCoordinatorForConsumer))
+	assert.False(isRetriableLeaderError(sarama.ErrRequestTimedOut))
+
+	assert.True(isRetriableCoordinatorError(sarama.ErrNotCoordinatorForConsumer))
+	assert.True(isRetriableCoordinatorError(sarama.ErrOffsetsLoadInProgress))
+	assert.False(isRetriableCoordinatorError(sarama.ErrNotLeaderForPartition))
+}
+
+func TestGetErrorEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	event := getErrorEvent(&Offset{Group: "test", Topic: "test-topic", Partition: 1, Err: sarama.ErrNotLeaderForPartition})
+	assert.Equal(int16(6), event["error"].(common.MapStr)["code"])
+	assert.Equal(sarama.ErrNotLeaderForPartition.Error(), event["error"].(common.MapStr)["message"])
+
+	event = getErrorEvent(&Offset{Group: "test", Topic: "test-topic", Partition: 1, Err: sarama.ErrOutOfBrokers})
+	assert.NotContains(event["error"], "code")
+}
+
+func TestComputeLag(t *testing.T) {
+	assert := assert.New(t)
+
+	committed := &Offset{Committed: true, ConsumerOffset: 90, BrokerOffset: 100, LogStartOffset: 20}
+	(&KafkaClient{uncommittedLag: uncommittedLagNone}).computeLag(committed)
+	assert.True(committed.HasLag)
+	assert.Equal(int64(10), committed.Lag)
+
+	expected := map[string]int64{
+		uncommittedLagLogStart: 80,
+		uncommittedLagLogEnd:   0,
+	}
+	for mode, lag := range expected {
+		o := &Offset{ConsumerOffset: -1, BrokerOffset: 100, LogStartOffset: 20}
+		(&KafkaClient{uncommittedLag: mode}).computeLag(o)
+		assert.True(o.HasLag, mode)
+		assert.Equal(lag, o.Lag, mode)
+	}
+
+	o := &Offset{ConsumerOffset: -1, BrokerOffset: 100, LogStartOffset: 20}
+	(&KafkaClient{uncommittedLag: uncommittedLagNone}).computeLag(o)
+	assert.False(o.HasLag)
+
+	// An open transaction holds the last stable offset back.
+	o = &Offset{Committed: true, ConsumerOffset: 90, BrokerOffset: 100, LastStable: 95, HasLastStable: true}
+	(&KafkaClient{uncommittedLag: uncommittedLagNone}).computeLag(o)
+	assert.Equal(int64(10), o.Lag)
+	assert.True(o.HasLagCommitted)
+	assert.Equal(int64(5), o.LagCommitted)
+
+	event := getOffsetEvent(o)
+	assert.Equal(int64(95), event["last_stable_offset"])
+	assert.Equal(int64(5), event["lag_committed"])
+	assert.Equal(int64(5), event["hwm_lso_gap"])
+}
+
+func initBrokers(seedBroker, coordinator, leader *sarama.MockBroker) {
+	initSeedBroker(seedBroker, coordinator, leader, 0, 2)
+
+	offsetRes := new(sarama.OffsetResponse)
+	offsetRes.AddTopicPartition("test-topic", 0, 111)
+	offsetRes.AddTopicPartition("test-topic", 1, 222)
+	leader.Returns(offsetRes)
+
+	oldestRes := new(sarama.OffsetResponse)
+	oldestRes.AddTopicPartition("test-topic", 0, 0)
+	oldestRes.AddTopicPartition("test-topic", 1, 21)
+	leader.Returns(oldestRes)
+
 	offsetFetchRes := new(sarama.OffsetFetchResponse)
 	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{
 		Err:      sarama.ErrNoError,
@@ -97,4 +555,61 @@ func initBrokers(seedBroker, coordinator, leader *sarama.MockBroker) {
 		Metadata: "",
 	})
 	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", map[string][]int32{"test-topic": {0}}))
+}
+
+// initSeedBroker queues the metadata of test-topic, with its partitions led
+// by leader, and the lookup of the coordinator. The metadata is returned for
+// the tests expecting it to be refreshed.
+func initSeedBroker(seedBroker, coordinator, leader *sarama.MockBroker, metadataVersion int16, partitions int32) *sarama.MetadataResponse {
+	metadateRes := metadataResponse(leader, metadataVersion, partitions)
+	seedBroker.Returns(metadateRes)
+	seedBroker.Returns(coordinatorResponse(coordinator))
+	return metadateRes
+}
+
+func metadataResponse(leader *sarama.MockBroker, version int16, partitions int32) *sarama.MetadataResponse {
+	metadateRes := &sarama.MetadataResponse{Version: version}
+	metadateRes.AddBroker(leader.Addr(), leader.BrokerID())
+	for partition := int32(0); partition < partitions; partition++ {
+		metadateRes.AddTopicPartition("test-topic", partition, leader.BrokerID(), nil, nil, nil, sarama.ErrNoError)
+	}
+	return metadateRes
+}
+
+func coordinatorResponse(coordinator *sarama.MockBroker) *sarama.ConsumerMetadataResponse {
+	coordinatorRes := new(sarama.ConsumerMetadataResponse)
+	coordinatorRes.CoordinatorID = coordinator.BrokerID()
+	coordinatorRes.CoordinatorHost = "127.0.0.1"
+	coordinatorRes.CoordinatorPort = coordinator.Port()
+	return coordinatorRes
+}
+
+func describeGroupsResponse(group string, assignment map[string][]int32) *sarama.DescribeGroupsResponse {
+	e := &testEncoder{}
+	e.int16(0).int32(int32(len(assignment)))
+	for topic, partitions := range assignment {
+		e.string(topic).int32(int32(len(partitions)))
+		for _, p := range partitions {
+			e.int32(p)
+		}
+	}
+	e.bytes(nil)
+
+	return &sarama.DescribeGroupsResponse{
+		Groups: []*sarama.GroupDescription{{
+			Err:          sarama.ErrNoError,
+			GroupId:      group,
+			State:        "Stable",
+			ProtocolType: "consumer",
+			Protocol:     "range",
+			Members: map[string]*sarama.GroupMemberDescription{
+				"member-1": {
+					ClientId:         "client-1",
+					ClientHost:       "/127.0.0.1",
+					MemberAssignment: e.Bytes(),
+				},
+			},
+		}},
+	}
 }
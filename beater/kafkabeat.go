@@ -53,7 +53,7 @@ func (bt *Kafkabeat) Setup(b *beat.Beat) error {
 	conf := bt.beatConfig.Kafkabeat
 
 	var err error
-	bt.client, err = NewKafkaClient(conf.Hosts, conf.ConsumerGroup, conf.Topics)
+	bt.client, err = NewKafkaClient(&conf)
 	if err != nil {
 		return err
 	}
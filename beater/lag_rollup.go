@@ -0,0 +1,75 @@
+package beater
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// lagRollup aggregates the lag of the partitions of a group, or of one topic
+// consumed by a group when topic is set.
+type lagRollup struct {
+	group      string
+	topic      string
+	totalLag   int64
+	maxLag     int64
+	partitions int
+	measured   int
+	lagging    int
+}
+
+func (r *lagRollup) add(o *Offset) {
+	r.partitions++
+	if !o.HasLag {
+		return
+	}
+
+	r.measured++
+	r.totalLag += o.Lag
+	if o.Lag > r.maxLag {
+		r.maxLag = o.Lag
+	}
+	if o.Lag > 0 {
+		r.lagging++
+	}
+}
+
+func (r *lagRollup) event() common.MapStr {
+	// Partitions without a lag are left out of the average.
+	var avgLag float64
+	if r.measured > 0 {
+		avgLag = float64(r.totalLag) / float64(r.measured)
+	}
+
+	event := common.MapStr{
+		"group":              r.group,
+		"total_lag":          r.totalLag,
+		"max_lag":            r.maxLag,
+		"avg_lag":            avgLag,
+		"partition_count":    r.partitions,
+		"lagging_partitions": r.lagging,
+	}
+	if r.topic != "" {
+		event["topic"] = r.topic
+	}
+	return event
+}
+
+// lagRollups builds the rollups of every group and of every topic of the
+// groups, in the order offsets are sorted.
+func lagRollups(offsets []*Offset) (groups, topics []*lagRollup) {
+	for _, o := range offsets {
+		if o.Err != nil {
+			continue
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].group != o.Group {
+			groups = append(groups, &lagRollup{group: o.Group})
+		}
+		groups[len(groups)-1].add(o)
+
+		if len(topics) == 0 || topics[len(topics)-1].group != o.Group || topics[len(topics)-1].topic != o.Topic {
+			topics = append(topics, &lagRollup{group: o.Group, topic: o.Topic})
+		}
+		topics[len(topics)-1].add(o)
+	}
+	return groups, topics
+}
@@ -0,0 +1,54 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func TestLagRollups(t *testing.T) {
+	assert := assert.New(t)
+
+	offsets := []*Offset{
+		{Group: "a", Topic: "t1", Partition: 0, Lag: 10, HasLag: true},
+		{Group: "a", Topic: "t1", Partition: 1, Lag: 0, HasLag: true},
+		{Group: "a", Topic: "t2", Partition: 0, Lag: 30, HasLag: true},
+		{Group: "a", Topic: "t2", Partition: 1},
+		{Group: "b", Topic: "t1", Partition: 0},
+	}
+
+	groups, topics := lagRollups(offsets)
+	assert.Len(groups, 2)
+	assert.Len(topics, 3)
+
+	a := groups[0].event()
+	assert.Equal("a", a["group"])
+	assert.NotContains(a, "topic")
+	assert.Equal(int64(40), a["total_lag"])
+	assert.Equal(int64(30), a["max_lag"])
+	assert.InDelta(40.0/3, a["avg_lag"], 0.001)
+	assert.Equal(4, a["partition_count"])
+	assert.Equal(2, a["lagging_partitions"])
+
+	t1 := topics[0].event()
+	assert.Equal("t1", t1["topic"])
+	assert.Equal(int64(10), t1["total_lag"])
+	assert.Equal(2, t1["partition_count"])
+	assert.Equal(1, t1["lagging_partitions"])
+
+	b := groups[1].event()
+	assert.Equal(int64(0), b["total_lag"])
+	assert.Equal(0.0, b["avg_lag"])
+	assert.Equal(1, b["partition_count"])
+	assert.Equal(0, b["lagging_partitions"])
+}
+
+func TestNewKafkaClientLagEvents(t *testing.T) {
+	_, err := NewKafkaClient(&config.KafkabeatConfig{
+		ConsumerGroup: "test",
+		LagEvents:     "everything",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,231 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	statusOK      = "OK"
+	statusWarning = "WARNING"
+	statusError   = "ERROR"
+	statusStall   = "STALL"
+	statusStop    = "STOP"
+	statusRewind  = "REWIND"
+)
+
+var statusSeverity = map[string]int{
+	statusOK:      0,
+	statusWarning: 1,
+	statusRewind:  2,
+	statusStall:   3,
+	statusStop:    4,
+}
+
+type groupPartitionKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+type consumerSample struct {
+	Timestamp      time.Time
+	ConsumerOffset int64
+	BrokerOffset   int64
+}
+
+func (s consumerSample) lag() int64 {
+	return s.BrokerOffset - s.ConsumerOffset
+}
+
+// consumerWindows keeps the most recent samples of every partition a group
+// consumes, in the spirit of Burrow's sliding window evaluation. The commits
+// read from __consumer_offsets are kept apart, once per commit, as a commit
+// is seen by several samples.
+type consumerWindows struct {
+	size    int
+	windows map[groupPartitionKey][]consumerSample
+	commits map[groupPartitionKey][]time.Time
+}
+
+func newConsumerWindows(size int) *consumerWindows {
+	return &consumerWindows{
+		size:    size,
+		windows: make(map[groupPartitionKey][]consumerSample),
+		commits: make(map[groupPartitionKey][]time.Time),
+	}
+}
+
+func (w *consumerWindows) add(key groupPartitionKey, sample consumerSample) {
+	samples := append(w.windows[key], sample)
+	if len(samples) > w.size {
+		samples = samples[len(samples)-w.size:]
+	}
+	w.windows[key] = samples
+}
+
+func (w *consumerWindows) addCommit(key groupPartitionKey, timestamp time.Time) {
+	commits := w.commits[key]
+	if len(commits) > 0 && !timestamp.After(commits[len(commits)-1]) {
+		return
+	}
+
+	commits = append(commits, timestamp)
+	if len(commits) > w.size {
+		commits = commits[len(commits)-w.size:]
+	}
+	w.commits[key] = commits
+}
+
+func (w *consumerWindows) get(key groupPartitionKey) []consumerSample {
+	return w.windows[key]
+}
+
+func (w *consumerWindows) prune(cutoff time.Time) {
+	for key, samples := range w.windows {
+		if samples[len(samples)-1].Timestamp.Before(cutoff) {
+			delete(w.windows, key)
+			delete(w.commits, key)
+		}
+	}
+}
+
+func (w *consumerWindows) status(key groupPartitionKey, now time.Time) string {
+	return evaluateStatus(w.windows[key], w.commits[key], w.size, now)
+}
+
+func evaluateStatus(samples []consumerSample, commits []time.Time, size int, now time.Time) string {
+	if len(samples) < 2 {
+		return statusOK
+	}
+
+	for i := 1; i < len(samples); i++ {
+		if samples[i].ConsumerOffset < samples[i-1].ConsumerOffset {
+			return statusRewind
+		}
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+
+	// The group stopped committing when its last commit is older than the
+	// time its recent commits span.
+	if last.lag() > 0 && len(commits) >= 2 {
+		firstCommit, lastCommit := commits[0], commits[len(commits)-1]
+		if now.Sub(lastCommit) > lastCommit.Sub(firstCommit) {
+			return statusStop
+		}
+	}
+
+	for _, s := range samples {
+		if s.lag() <= 0 {
+			return statusOK
+		}
+	}
+
+	if len(samples) < size {
+		return statusOK
+	}
+
+	if first.ConsumerOffset == last.ConsumerOffset {
+		return statusStall
+	}
+
+	for i := 1; i < len(samples); i++ {
+		if samples[i].lag() < samples[i-1].lag() {
+			return statusOK
+		}
+	}
+	if last.lag() > first.lag() {
+		return statusWarning
+	}
+
+	return statusOK
+}
+
+type groupStatus struct {
+	group          string
+	totalLag       int64
+	partitionCount int
+	worst          *Offset
+	worstStatus    string
+
+	drainETA  float64
+	undrained bool
+	breachETA float64
+	hasBreach bool
+}
+
+func (g *groupStatus) add(o *Offset, status string) {
+	g.totalLag += o.Lag
+	g.partitionCount++
+
+	if g.worst == nil ||
+		statusSeverity[status] > statusSeverity[g.worstStatus] ||
+		(statusSeverity[status] == statusSeverity[g.worstStatus] && o.Lag > g.worst.Lag) {
+		g.worst = o
+		g.worstStatus = status
+	}
+}
+
+// addETA rolls up the estimates of a partition: the group drains when its
+// slowest partition does and breaches when its first partition does.
+func (g *groupStatus) addETA(eta *lagETA) {
+	if !eta.HasDrain {
+		g.undrained = true
+	} else if eta.Drain > g.drainETA {
+		g.drainETA = eta.Drain
+	}
+
+	if eta.HasBreach && (!g.hasBreach || eta.Breach < g.breachETA) {
+		g.breachETA = eta.Breach
+		g.hasBreach = true
+	}
+}
+
+func (g *groupStatus) status() string {
+	switch g.worstStatus {
+	case statusStall, statusStop:
+		return statusError
+	case statusWarning, statusRewind:
+		return statusWarning
+	default:
+		return statusOK
+	}
+}
+
+func (g *groupStatus) event() common.MapStr {
+	event := common.MapStr{
+		"group":           g.group,
+		"status":          g.status(),
+		"total_lag":       g.totalLag,
+		"partition_count": g.partitionCount,
+		"worst_partition": common.MapStr{
+			"topic":     g.worst.Topic,
+			"partition": g.worst.Partition,
+			"status":    g.worstStatus,
+			"lag":       g.worst.Lag,
+		},
+	}
+	if !g.undrained {
+		event["eta_drain_seconds"] = g.drainETA
+	}
+	if g.hasBreach {
+		event["eta_breach_seconds"] = g.breachETA
+	}
+	return event
+}
+
+func (w *consumerWindows) consumeRate(key groupPartitionKey) (float64, bool) {
+	samples := w.windows[key]
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.Timestamp.Sub(first.Timestamp).Seconds()
+	if elapsed <= 0 || last.ConsumerOffset < first.ConsumerOffset {
+		return 0, false
+	}
+	return float64(last.ConsumerOffset-first.ConsumerOffset) / elapsed, true
+}
@@ -0,0 +1,174 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func samplesOf(offsets ...[2]int64) []consumerSample {
+	start := time.Unix(1462174414, 0)
+	var samples []consumerSample
+	for i, o := range offsets {
+		samples = append(samples, consumerSample{
+			Timestamp:      start.Add(time.Duration(i) * 30 * time.Second),
+			ConsumerOffset: o[0],
+			BrokerOffset:   o[1],
+		})
+	}
+	return samples
+}
+
+func TestEvaluateStatus(t *testing.T) {
+	now := time.Unix(1462174414, 0).Add(2 * time.Minute)
+	assert := assert.New(t)
+
+	assert.Equal(statusOK, evaluateStatus(samplesOf([2]int64{10, 20}), nil, 4, now))
+
+	assert.Equal(statusOK, evaluateStatus(samplesOf(
+		[2]int64{10, 20}, [2]int64{20, 30}, [2]int64{30, 30}, [2]int64{35, 40},
+	), nil, 4, now))
+
+	assert.Equal(statusRewind, evaluateStatus(samplesOf(
+		[2]int64{10, 20}, [2]int64{5, 30},
+	), nil, 4, now))
+
+	assert.Equal(statusStall, evaluateStatus(samplesOf(
+		[2]int64{10, 20}, [2]int64{10, 30}, [2]int64{10, 40}, [2]int64{10, 50},
+	), nil, 4, now))
+
+	assert.Equal(statusWarning, evaluateStatus(samplesOf(
+		[2]int64{10, 20}, [2]int64{15, 30}, [2]int64{20, 40}, [2]int64{25, 50},
+	), nil, 4, now))
+
+	// Catching up, the lag shrinks.
+	assert.Equal(statusOK, evaluateStatus(samplesOf(
+		[2]int64{10, 50}, [2]int64{20, 50}, [2]int64{30, 55}, [2]int64{40, 60},
+	), nil, 4, now))
+
+	// Not enough samples to tell a stalled consumer apart.
+	assert.Equal(statusOK, evaluateStatus(samplesOf(
+		[2]int64{10, 20}, [2]int64{10, 30},
+	), nil, 4, now))
+}
+
+func TestEvaluateStatusStop(t *testing.T) {
+	samples := samplesOf([2]int64{10, 20}, [2]int64{20, 35}, [2]int64{30, 50})
+	var commits []time.Time
+	for _, s := range samples {
+		commits = append(commits, s.Timestamp)
+	}
+
+	last := samples[len(samples)-1].Timestamp
+	assert := assert.New(t)
+	assert.Equal(statusStop, evaluateStatus(samples, commits, 3, last.Add(2*time.Minute)))
+	assert.Equal(statusWarning, evaluateStatus(samples, commits, 3, last.Add(30*time.Second)))
+
+	// A single commit doesn't tell how often the group commits.
+	assert.Equal(statusWarning, evaluateStatus(samples, commits[2:], 3, last.Add(2*time.Minute)))
+}
+
+// consumerStatuses polls a consumer every 10 seconds, committing offset(i) at
+// poll i, and returns the status after every poll. Commits are only recorded
+// at the polls where commit(i) is true.
+func consumerStatuses(polls int, offset func(i int) int64, commit func(i int) bool) []string {
+	w := newConsumerWindows(4)
+	key := groupPartitionKey{"test", "test-topic", 0}
+	start := time.Unix(1462174414, 0)
+
+	var statuses []string
+	for i := 0; i < polls; i++ {
+		now := start.Add(time.Duration(i) * 10 * time.Second)
+		if commit(i) {
+			w.addCommit(key, now)
+		}
+		w.add(key, consumerSample{
+			Timestamp:      now,
+			ConsumerOffset: offset(i),
+			BrokerOffset:   100 + int64(i)*10,
+		})
+		statuses = append(statuses, w.status(key, now))
+	}
+	return statuses
+}
+
+func TestConsumerWindowsStalled(t *testing.T) {
+	stalled := func(i int) int64 { return 10 }
+	assert := assert.New(t)
+
+	// Polled offsets don't tell when the group committed.
+	never := func(i int) bool { return false }
+	assert.Equal([]string{statusOK, statusOK, statusOK, statusStall, statusStall},
+		consumerStatuses(5, stalled, never))
+
+	// The group commits the same offset again and again.
+	always := func(i int) bool { return true }
+	assert.Equal([]string{statusOK, statusOK, statusOK, statusStall, statusStall},
+		consumerStatuses(5, stalled, always))
+}
+
+func TestConsumerWindowsSlowCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	// Committing every 30 seconds while catching up.
+	offset := func(i int) int64 { return 90 + int64(i/3)*40 }
+	every30s := func(i int) bool { return i%3 == 0 }
+	for _, status := range consumerStatuses(12, offset, every30s) {
+		assert.Equal(statusOK, status)
+	}
+
+	// The group stops committing after 60 seconds, stalled first.
+	offset = func(i int) int64 {
+		if i > 6 {
+			i = 6
+		}
+		return 90 + int64(i/3)*10
+	}
+	until60s := func(i int) bool { return i%3 == 0 && i <= 6 }
+	statuses := consumerStatuses(14, offset, until60s)
+	assert.Equal(statusStall, statuses[12])
+	assert.Equal(statusStop, statuses[13])
+}
+
+func TestGroupStatus(t *testing.T) {
+	g := &groupStatus{group: "test"}
+	g.add(&Offset{Group: "test", Topic: "a", Partition: 0, Lag: 100}, statusOK)
+	g.add(&Offset{Group: "test", Topic: "a", Partition: 1, Lag: 10}, statusStall)
+	g.add(&Offset{Group: "test", Topic: "b", Partition: 0, Lag: 5}, statusWarning)
+
+	event := g.event()
+
+	assert := assert.New(t)
+	assert.Equal(statusError, event["status"])
+	assert.Equal(int64(115), event["total_lag"])
+	assert.Equal(3, event["partition_count"])
+	assert.Equal(common.MapStr{
+		"topic":     "a",
+		"partition": int32(1),
+		"status":    statusStall,
+		"lag":       int64(10),
+	}, event["worst_partition"])
+}
+
+func TestGroupStatusETA(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &groupStatus{group: "test"}
+	g.addETA(&lagETA{Drain: 30, HasDrain: true})
+	g.addETA(&lagETA{Drain: 60, HasDrain: true})
+	g.addETA(&lagETA{HasDrain: true})
+	g.add(&Offset{Group: "test", Topic: "a", Partition: 0}, statusOK)
+
+	event := g.event()
+	assert.Equal(60.0, event["eta_drain_seconds"])
+	assert.NotContains(event, "eta_breach_seconds")
+
+	g.addETA(&lagETA{Breach: 120, HasBreach: true})
+	g.addETA(&lagETA{Breach: 90, HasBreach: true})
+
+	event = g.event()
+	assert.NotContains(event, "eta_drain_seconds")
+	assert.Equal(90.0, event["eta_breach_seconds"])
+}
@@ -0,0 +1,127 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const oauthRequestTimeout = 10 * time.Second
+
+// oauthTokenProvider gets OAUTHBEARER tokens from a token endpoint with the
+// client credentials grant. Tokens are cached and refreshed once 80% of their
+// lifetime has passed, so connections made later on never get an expired one.
+type oauthTokenProvider struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+	now          func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func newOAuthTokenProvider(tokenURL, clientID, clientSecret string, scopes []string) *oauthTokenProvider {
+	return &oauthTokenProvider{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: oauthRequestTimeout},
+		now:          time.Now,
+	}
+}
+
+func (p *oauthTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if p.token != "" && now.Before(p.refreshAt) {
+		return &sarama.AccessToken{Token: p.token}, nil
+	}
+
+	token, lifetime, err := p.requestToken()
+	if err != nil {
+		// A token that is due for refresh is still good until it expires.
+		if p.token != "" && now.Before(p.expiresAt) {
+			logp.Warn("Failed to refresh OAuth token, using the current one until it expires: %v", err)
+			return &sarama.AccessToken{Token: p.token}, nil
+		}
+		return nil, err
+	}
+
+	p.token = token
+	p.expiresAt = now.Add(lifetime)
+	p.refreshAt = now.Add(lifetime * 4 / 5)
+	return &sarama.AccessToken{Token: p.token}, nil
+}
+
+func (p *oauthTokenProvider) requestToken() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(p.scopes) > 0 {
+		form.Set("scope", strings.Join(p.scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth token request to %s failed: %v", p.tokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth token request to %s failed: %v", p.tokenURL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth token request to %s failed: %v", p.tokenURL, err)
+	}
+
+	var token oauthTokenResponse
+	decodeErr := json.Unmarshal(body, &token)
+
+	if resp.StatusCode != http.StatusOK {
+		if decodeErr == nil && token.Error != "" {
+			return "", 0, fmt.Errorf("OAuth token request to %s failed with %s: %s %s",
+				p.tokenURL, resp.Status, token.Error, token.ErrorDescription)
+		}
+		return "", 0, fmt.Errorf("OAuth token request to %s failed with %s", p.tokenURL, resp.Status)
+	}
+	if decodeErr != nil {
+		return "", 0, fmt.Errorf("Invalid OAuth token response from %s: %v", p.tokenURL, decodeErr)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("Invalid OAuth token response from %s: no access_token", p.tokenURL)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("Invalid OAuth token response from %s: token_type %q is not bearer", p.tokenURL, token.TokenType)
+	}
+
+	// Tokens without an expiry are requested again for every connection.
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,137 @@
+package beater
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+type tokenServer struct {
+	*httptest.Server
+	requests int
+	fail     bool
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests++
+
+		id, secret, _ := r.BasicAuth()
+		if s.fail || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad credentials"}`)
+			return
+		}
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "kafka metrics", r.FormValue("scope"))
+
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":100}`, s.requests)
+	}))
+	return s
+}
+
+func TestOAuthTokenProvider(t *testing.T) {
+	server := newTokenServer(t)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	now := time.Unix(1000, 0)
+	provider := newOAuthTokenProvider(server.URL, "client", "secret", []string{"kafka", "metrics"})
+	provider.now = func() time.Time { return now }
+
+	token, err := provider.Token()
+	assert.NoError(err)
+	assert.Equal("token-1", token.Token)
+
+	// Cached until 80% of the lifetime has passed.
+	now = now.Add(79 * time.Second)
+	token, err = provider.Token()
+	assert.NoError(err)
+	assert.Equal("token-1", token.Token)
+	assert.Equal(1, server.requests)
+
+	now = now.Add(2 * time.Second)
+	token, err = provider.Token()
+	assert.NoError(err)
+	assert.Equal("token-2", token.Token)
+
+	// A failed refresh falls back on the current token until it expires.
+	server.fail = true
+	now = now.Add(90 * time.Second)
+	token, err = provider.Token()
+	assert.NoError(err)
+	assert.Equal("token-2", token.Token)
+
+	now = now.Add(20 * time.Second)
+	_, err = provider.Token()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "invalid_client bad credentials")
+	}
+}
+
+func TestOAuthTokenProviderErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			fmt.Fprint(w, `{"token_type":"Bearer"}`)
+		case "/mac":
+			fmt.Fprint(w, `{"access_token":"token","token_type":"mac"}`)
+		default:
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/empty", "/mac", "/error"} {
+		_, err := newOAuthTokenProvider(server.URL+path, "client", "secret", nil).Token()
+		assert.Error(err, path)
+	}
+
+	_, err := newOAuthTokenProvider("http://127.0.0.1:0/token", "client", "secret", nil).Token()
+	assert.Error(err)
+}
+
+func TestNewKafkaClientOAuth(t *testing.T) {
+	server := newTokenServer(t)
+	defer server.Close()
+
+	seedBroker := sarama.NewMockBroker(t, 1)
+	seedBroker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"SaslHandshakeRequest": sarama.NewMockSaslHandshakeResponse(t).
+			SetEnabledMechanisms([]string{sarama.SASLTypeOAuth}),
+		"SaslAuthenticateRequest": sarama.NewMockSaslAuthenticateResponse(t),
+	})
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		SASL: config.SASLConfig{
+			Mechanism: "OAUTHBEARER",
+			Username:  "client",
+			Password:  "secret",
+			TokenURL:  server.URL,
+			Scopes:    []string{"kafka", "metrics"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, server.requests)
+
+	seedBroker.Close()
+	safeClose(t, client)
+}
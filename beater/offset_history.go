@@ -0,0 +1,180 @@
+package beater
+
+import (
+	"time"
+)
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+type offsetSample struct {
+	Timestamp time.Time
+	Offset    int64
+}
+
+type offsetSamples struct {
+	samples  []offsetSample
+	lastSeen time.Time
+}
+
+// brokerOffsetHistory remembers when the log end offset of each partition
+// reached a given value, which is used to turn a consumer offset into a time lag.
+type brokerOffsetHistory struct {
+	retention  time.Duration
+	partitions map[partitionKey]*offsetSamples
+}
+
+func newBrokerOffsetHistory(retention time.Duration) *brokerOffsetHistory {
+	return &brokerOffsetHistory{
+		retention:  retention,
+		partitions: make(map[partitionKey]*offsetSamples),
+	}
+}
+
+func (h *brokerOffsetHistory) add(topic string, partition int32, offset int64, now time.Time) {
+	key := partitionKey{topic, partition}
+	p, ok := h.partitions[key]
+	if !ok {
+		p = &offsetSamples{}
+		h.partitions[key] = p
+	}
+	p.lastSeen = now
+
+	if n := len(p.samples); n > 0 {
+		last := p.samples[n-1]
+		if offset == last.Offset {
+			return
+		}
+		if offset < last.Offset {
+			// The partition was recreated or truncated, older samples are meaningless.
+			p.samples = p.samples[:0]
+		}
+	}
+	p.samples = append(p.samples, offsetSample{Timestamp: now, Offset: offset})
+
+	cutoff := now.Add(-h.retention)
+	for len(p.samples) > 1 && p.samples[1].Timestamp.Before(cutoff) {
+		p.samples = p.samples[1:]
+	}
+}
+
+func (h *brokerOffsetHistory) prune(now time.Time) {
+	cutoff := now.Add(-h.retention)
+	for key, p := range h.partitions {
+		if p.lastSeen.Before(cutoff) {
+			delete(h.partitions, key)
+		}
+	}
+}
+
+func (h *brokerOffsetHistory) lagSeconds(topic string, partition int32, consumerOffset int64, now time.Time) (float64, bool) {
+	p, ok := h.partitions[partitionKey{topic, partition}]
+	if !ok || len(p.samples) == 0 {
+		return 0, false
+	}
+	samples := p.samples
+
+	if consumerOffset >= samples[len(samples)-1].Offset {
+		return 0, true
+	}
+
+	// The oldest unconsumed message is at the consumer offset, it was produced
+	// when the log end offset went past it.
+	end := consumerOffset + 1
+	i := 0
+	for samples[i].Offset < end {
+		i++
+	}
+
+	var produced time.Time
+	if i == 0 {
+		// The consumer is behind everything we have seen, extrapolate with the
+		// average produce rate over the history.
+		if len(samples) < 2 {
+			return 0, false
+		}
+		first, last := samples[0], samples[len(samples)-1]
+		produced = interpolate(first, last, end)
+	} else {
+		produced = interpolate(samples[i-1], samples[i], end)
+	}
+
+	lag := now.Sub(produced).Seconds()
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, true
+}
+
+func interpolate(a, b offsetSample, offset int64) time.Time {
+	ratio := float64(offset-a.Offset) / float64(b.Offset-a.Offset)
+	return a.Timestamp.Add(time.Duration(ratio * float64(b.Timestamp.Sub(a.Timestamp))))
+}
+
+type observedCommit struct {
+	offsetSample
+	lastSeen time.Time
+}
+
+// commitTracker approximates commit timestamps when offsets are polled, by
+// remembering when the committed offset of a partition last changed. They
+// don't move while a consumer commits the same offset, so they are only
+// reported and not used to tell stopped consumers apart. They start over
+// when kafkabeat restarts.
+type commitTracker struct {
+	commits map[groupPartitionKey]*observedCommit
+}
+
+func newCommitTracker() *commitTracker {
+	return &commitTracker{commits: make(map[groupPartitionKey]*observedCommit)}
+}
+
+func (t *commitTracker) observe(key groupPartitionKey, offset int64, now time.Time) time.Time {
+	c, ok := t.commits[key]
+	if !ok || c.Offset != offset {
+		c = &observedCommit{offsetSample: offsetSample{Timestamp: now, Offset: offset}}
+		t.commits[key] = c
+	}
+	c.lastSeen = now
+	return c.Timestamp
+}
+
+func (t *commitTracker) prune(cutoff time.Time) {
+	for key, c := range t.commits {
+		if c.lastSeen.Before(cutoff) {
+			delete(t.commits, key)
+		}
+	}
+}
+
+// rate returns how fast the offset of a partition has been moving over the
+// history, in messages per second.
+func (h *brokerOffsetHistory) rate(topic string, partition int32, now time.Time) (float64, bool) {
+	p, ok := h.partitions[partitionKey{topic, partition}]
+	if !ok || len(p.samples) < 2 {
+		return 0, false
+	}
+
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := now.Sub(first.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return float64(last.Offset-first.Offset) / elapsed, true
+}
+
+// retentionETA estimates the seconds left until the log start offset, moved
+// forward by retention, passes the committed offset of the consumer.
+func retentionETA(o *Offset, deleteRate, consumeRate float64) (float64, bool) {
+	if o.ConsumerOffset < o.LogStartOffset {
+		return 0, true
+	}
+
+	closing := deleteRate - consumeRate
+	if closing <= 0 {
+		return 0, false
+	}
+	return float64(o.ConsumerOffset-o.LogStartOffset) / closing, true
+}
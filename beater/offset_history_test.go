@@ -0,0 +1,127 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerOffsetHistoryLagSeconds(t *testing.T) {
+	h := newBrokerOffsetHistory(time.Hour)
+	start := time.Unix(1462174414, 0)
+
+	h.add("test", 0, 100, start)
+	h.add("test", 0, 200, start.Add(10*time.Second))
+	h.add("test", 0, 400, start.Add(20*time.Second))
+
+	now := start.Add(20 * time.Second)
+	assert := assert.New(t)
+
+	lag, ok := h.lagSeconds("test", 0, 400, now)
+	assert.True(ok)
+	assert.Equal(float64(0), lag)
+
+	// Message 300 was produced when the log end offset reached 301.
+	lag, ok = h.lagSeconds("test", 0, 300, now)
+	assert.True(ok)
+	assert.InDelta(4.95, lag, 0.001)
+
+	lag, ok = h.lagSeconds("test", 0, 150, now)
+	assert.True(ok)
+	assert.InDelta(14.9, lag, 0.001)
+
+	// Older than the history, extrapolated with the average rate of 15 msg/s.
+	lag, ok = h.lagSeconds("test", 0, 70, now)
+	assert.True(ok)
+	assert.InDelta(21.933, lag, 0.001)
+
+	_, ok = h.lagSeconds("test", 1, 70, now)
+	assert.False(ok)
+}
+
+func TestBrokerOffsetHistoryLagSecondsOneBehind(t *testing.T) {
+	h := newBrokerOffsetHistory(time.Hour)
+	start := time.Unix(1462174414, 0)
+
+	// Message 100 was produced between the two samples and not consumed yet.
+	h.add("test", 0, 100, start)
+	h.add("test", 0, 101, start.Add(10*time.Second))
+
+	lag, ok := h.lagSeconds("test", 0, 100, start.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.InDelta(t, 20, lag, 0.001)
+
+	lag, ok = h.lagSeconds("test", 0, 101, start.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), lag)
+}
+
+func TestBrokerOffsetHistoryReset(t *testing.T) {
+	h := newBrokerOffsetHistory(time.Hour)
+	start := time.Unix(1462174414, 0)
+
+	h.add("test", 0, 100, start)
+	h.add("test", 0, 200, start.Add(10*time.Second))
+	h.add("test", 0, 50, start.Add(20*time.Second))
+
+	_, ok := h.lagSeconds("test", 0, 10, start.Add(20*time.Second))
+	assert.False(t, ok)
+}
+
+func TestBrokerOffsetHistoryRetention(t *testing.T) {
+	h := newBrokerOffsetHistory(time.Minute)
+	start := time.Unix(1462174414, 0)
+
+	h.add("test", 0, 100, start)
+	h.add("test", 0, 200, start.Add(30*time.Second))
+	h.add("test", 0, 300, start.Add(100*time.Second))
+
+	assert.Len(t, h.partitions[partitionKey{"test", 0}].samples, 2)
+
+	h.prune(start.Add(200 * time.Second))
+	assert.Len(t, h.partitions, 0)
+}
+
+func TestCommitTracker(t *testing.T) {
+	tracker := newCommitTracker()
+	key := groupPartitionKey{"test", "test", 0}
+	start := time.Unix(1462174414, 0)
+
+	assert := assert.New(t)
+	assert.Equal(start, tracker.observe(key, 10, start))
+	assert.Equal(start, tracker.observe(key, 10, start.Add(30*time.Second)))
+	assert.Equal(start.Add(time.Minute), tracker.observe(key, 20, start.Add(time.Minute)))
+
+	tracker.prune(start.Add(2 * time.Minute))
+	assert.Len(tracker.commits, 0)
+}
+
+func TestBrokerOffsetHistoryRate(t *testing.T) {
+	h := newBrokerOffsetHistory(time.Hour)
+	start := time.Unix(1462174414, 0)
+
+	h.add("test", 0, 100, start)
+	_, ok := h.rate("test", 0, start.Add(10*time.Second))
+	assert.False(t, ok)
+
+	h.add("test", 0, 300, start.Add(10*time.Second))
+	rate, ok := h.rate("test", 0, start.Add(20*time.Second))
+	assert.True(t, ok)
+	assert.InDelta(t, 10, rate, 0.001)
+}
+
+func TestRetentionETA(t *testing.T) {
+	assert := assert.New(t)
+
+	eta, ok := retentionETA(&Offset{ConsumerOffset: 50, LogStartOffset: 100}, 10, 0)
+	assert.True(ok)
+	assert.Equal(float64(0), eta)
+
+	eta, ok = retentionETA(&Offset{ConsumerOffset: 300, LogStartOffset: 100}, 10, 5)
+	assert.True(ok)
+	assert.InDelta(40, eta, 0.001)
+
+	_, ok = retentionETA(&Offset{ConsumerOffset: 300, LogStartOffset: 100}, 10, 20)
+	assert.False(ok)
+}
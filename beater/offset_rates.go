@@ -0,0 +1,151 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+type partitionSample struct {
+	Timestamp      time.Time
+	BrokerOffset   int64
+	ConsumerOffset int64
+	Committed      bool
+	Lag            int64
+	HasLag         bool
+}
+
+// offsetRates are the rates of a partition between two periods, in messages
+// per second. A rate is only set when both samples allow computing it.
+type offsetRates struct {
+	ProduceRate    float64
+	ConsumeRate    float64
+	LagRate        float64
+	HasProduceRate bool
+	HasConsumeRate bool
+	HasLagRate     bool
+}
+
+func (r *offsetRates) addTo(event common.MapStr) {
+	if r.HasProduceRate {
+		event["produce_rate"] = r.ProduceRate
+	}
+	if r.HasConsumeRate {
+		event["consume_rate"] = r.ConsumeRate
+	}
+	if r.HasLagRate {
+		event["lag_rate_of_change"] = r.LagRate
+	}
+}
+
+// rateTracker keeps the previous sample of every partition of every group to
+// derive produce and consume rates from the offset deltas.
+type rateTracker struct {
+	previous map[groupPartitionKey]*partitionSample
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{previous: make(map[groupPartitionKey]*partitionSample)}
+}
+
+func (t *rateTracker) observe(o *Offset, now time.Time) *offsetRates {
+	key := groupPartitionKey{o.Group, o.Topic, o.Partition}
+	current := &partitionSample{
+		Timestamp:      now,
+		BrokerOffset:   o.BrokerOffset,
+		ConsumerOffset: o.ConsumerOffset,
+		Committed:      o.Committed,
+		Lag:            o.Lag,
+		HasLag:         o.HasLag,
+	}
+	prev, ok := t.previous[key]
+	t.previous[key] = current
+
+	rates := &offsetRates{}
+	if !ok {
+		return rates
+	}
+
+	elapsed := now.Sub(prev.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return rates
+	}
+
+	// An offset going backwards means the partition was recreated or the
+	// group reset its offsets, the delta is meaningless then.
+	produceReset := current.BrokerOffset < prev.BrokerOffset
+	if !produceReset {
+		rates.ProduceRate = float64(current.BrokerOffset-prev.BrokerOffset) / elapsed
+		rates.HasProduceRate = true
+	}
+
+	bothCommitted := prev.Committed && current.Committed
+	consumeReset := bothCommitted && current.ConsumerOffset < prev.ConsumerOffset
+	if bothCommitted && !consumeReset {
+		rates.ConsumeRate = float64(current.ConsumerOffset-prev.ConsumerOffset) / elapsed
+		rates.HasConsumeRate = true
+	}
+
+	if prev.HasLag && current.HasLag && prev.Committed == current.Committed && !produceReset && !consumeReset {
+		rates.LagRate = float64(current.Lag-prev.Lag) / elapsed
+		rates.HasLagRate = true
+	}
+	return rates
+}
+
+func (t *rateTracker) prune(cutoff time.Time) {
+	for key, s := range t.previous {
+		if s.Timestamp.Before(cutoff) {
+			delete(t.previous, key)
+		}
+	}
+}
+
+// lagETA estimates how long a partition takes to catch up at its current
+// rates, or how long until its lag crosses the threshold when it is falling
+// behind.
+type lagETA struct {
+	Drain     float64
+	Breach    float64
+	HasDrain  bool
+	HasBreach bool
+}
+
+func estimateLagETA(o *Offset, rates *offsetRates, threshold int64) *lagETA {
+	eta := &lagETA{}
+	if !o.HasLag {
+		return eta
+	}
+	if o.Lag <= 0 {
+		eta.HasDrain = true
+		return eta
+	}
+	if !rates.HasProduceRate || !rates.HasConsumeRate {
+		return eta
+	}
+
+	closing := rates.ConsumeRate - rates.ProduceRate
+	if closing > 0 {
+		eta.Drain, eta.HasDrain = float64(o.Lag)/closing, true
+		return eta
+	}
+
+	if threshold <= 0 {
+		return eta
+	}
+	if o.Lag >= threshold {
+		eta.Breach, eta.HasBreach = 0, true
+	} else if closing < 0 {
+		eta.Breach, eta.HasBreach = float64(threshold-o.Lag)/-closing, true
+	}
+	return eta
+}
+
+func (e *lagETA) addTo(event common.MapStr) {
+	if e.HasDrain {
+		event["eta_drain_seconds"] = e.Drain
+	}
+	if e.HasBreach {
+		event["eta_breach_seconds"] = e.Breach
+	}
+}
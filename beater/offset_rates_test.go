@@ -0,0 +1,74 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newRateTracker()
+	start := time.Unix(1462174414, 0)
+	observe := func(o *Offset, seconds int) common.MapStr {
+		event := common.MapStr{}
+		tracker.observe(o, start.Add(time.Duration(seconds)*time.Second)).addTo(event)
+		return event
+	}
+
+	// The first sample has nothing to compare with.
+	event := observe(&Offset{Group: "g", Topic: "t", BrokerOffset: 100, ConsumerOffset: 50, Committed: true, Lag: 50, HasLag: true}, 0)
+	assert.Empty(event)
+
+	event = observe(&Offset{Group: "g", Topic: "t", BrokerOffset: 200, ConsumerOffset: 100, Committed: true, Lag: 100, HasLag: true}, 10)
+	assert.Equal(10.0, event["produce_rate"])
+	assert.Equal(5.0, event["consume_rate"])
+	assert.Equal(5.0, event["lag_rate_of_change"])
+
+	// The group reset its offsets.
+	event = observe(&Offset{Group: "g", Topic: "t", BrokerOffset: 300, ConsumerOffset: 0, Committed: true, Lag: 300, HasLag: true}, 20)
+	assert.Equal(10.0, event["produce_rate"])
+	assert.NotContains(event, "consume_rate")
+	assert.NotContains(event, "lag_rate_of_change")
+
+	// The partition was recreated.
+	event = observe(&Offset{Group: "g", Topic: "t", BrokerOffset: 10, ConsumerOffset: 10, Committed: true, Lag: 0, HasLag: true}, 30)
+	assert.NotContains(event, "produce_rate")
+	assert.Equal(1.0, event["consume_rate"])
+	assert.NotContains(event, "lag_rate_of_change")
+
+	event = observe(&Offset{Group: "g", Topic: "t", BrokerOffset: 20, ConsumerOffset: -1, Lag: 20, HasLag: true}, 40)
+	assert.Equal(1.0, event["produce_rate"])
+	assert.NotContains(event, "consume_rate")
+	assert.NotContains(event, "lag_rate_of_change")
+
+	tracker.prune(start.Add(time.Minute))
+	assert.Empty(tracker.previous)
+}
+
+func TestEstimateLagETA(t *testing.T) {
+	assert := assert.New(t)
+
+	rates := &offsetRates{ProduceRate: 10, ConsumeRate: 30, HasProduceRate: true, HasConsumeRate: true}
+	eta := estimateLagETA(&Offset{Lag: 200, HasLag: true}, rates, 1000)
+	assert.Equal(&lagETA{Drain: 10, HasDrain: true}, eta)
+
+	eta = estimateLagETA(&Offset{Lag: 0, HasLag: true}, &offsetRates{}, 1000)
+	assert.Equal(&lagETA{HasDrain: true}, eta)
+
+	rates = &offsetRates{ProduceRate: 30, ConsumeRate: 10, HasProduceRate: true, HasConsumeRate: true}
+	eta = estimateLagETA(&Offset{Lag: 200, HasLag: true}, rates, 1000)
+	assert.Equal(&lagETA{Breach: 40, HasBreach: true}, eta)
+
+	eta = estimateLagETA(&Offset{Lag: 2000, HasLag: true}, rates, 1000)
+	assert.Equal(&lagETA{Breach: 0, HasBreach: true}, eta)
+
+	eta = estimateLagETA(&Offset{Lag: 200, HasLag: true}, rates, 0)
+	assert.Equal(&lagETA{}, eta)
+
+	eta = estimateLagETA(&Offset{Lag: 200, HasLag: true}, &offsetRates{HasProduceRate: true}, 1000)
+	assert.Equal(&lagETA{}, eta)
+}
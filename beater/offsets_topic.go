@@ -0,0 +1,437 @@
+package beater
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const offsetsTopic = "__consumer_offsets"
+
+type committedOffset struct {
+	Offset    int64
+	Metadata  string
+	Timestamp time.Time
+}
+
+type groupMetadata struct {
+	Group        string
+	State        string
+	Coordinator  int32
+	ProtocolType string
+	Protocol     string
+	Members      []*groupMember
+}
+
+type groupMember struct {
+	MemberID   string
+	ClientID   string
+	ClientHost string
+	Assignment []byte
+}
+
+type offsetCommitKey struct {
+	Group     string
+	Topic     string
+	Partition int32
+}
+
+type groupMetadataKey struct {
+	Group string
+}
+
+// loggedGroup is the last group metadata the coordinator wrote to a
+// partition of __consumer_offsets.
+type loggedGroup struct {
+	metadata  *groupMetadata
+	partition int32
+}
+
+// pendingPartition tracks a partition of __consumer_offsets until it has been
+// read up to the end it had when the collector started.
+type pendingPartition struct {
+	consumer sarama.PartitionConsumer
+	end      int64
+	offset   int64
+	checked  int64
+}
+
+// caughtUp reports whether the partition has been read up to its end. The
+// last offsets may hold transaction markers, which are never delivered, so
+// the partition is also caught up once the consumer's high water mark has
+// reached the end and nothing was read since the previous check.
+func (p *pendingPartition) caughtUp() bool {
+	idle := p.offset == p.checked && len(p.consumer.Messages()) == 0 &&
+		p.consumer.HighWaterMarkOffset() >= p.end
+	p.checked = p.offset
+	return idle
+}
+
+// offsetsTopicCollector consumes __consumer_offsets and keeps the latest
+// commit of every group, so offsets don't need to be polled with OffsetFetch.
+type offsetsTopicCollector struct {
+	consumer  sarama.Consumer
+	consumers []sarama.PartitionConsumer
+	wg        sync.WaitGroup
+
+	mu      sync.RWMutex
+	offsets map[groupPartitionKey]*committedOffset
+	groups  map[string]*loggedGroup
+	pending map[int32]*pendingPartition
+	caught  bool
+}
+
+func newOffsetsTopicCollector(client sarama.Client) (*offsetsTopicCollector, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &offsetsTopicCollector{
+		consumer: consumer,
+		offsets:  make(map[groupPartitionKey]*committedOffset),
+		groups:   make(map[string]*loggedGroup),
+		pending:  make(map[int32]*pendingPartition),
+	}
+
+	if err := c.start(client); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *offsetsTopicCollector) start(client sarama.Client) error {
+	partitions, err := client.Partitions(offsetsTopic)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		oldest, err := client.GetOffset(offsetsTopic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		newest, err := client.GetOffset(offsetsTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+
+		pc, err := c.consumer.ConsumePartition(offsetsTopic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		c.consumers = append(c.consumers, pc)
+
+		if newest > oldest {
+			c.mu.Lock()
+			c.pending[partition] = &pendingPartition{consumer: pc, end: newest, offset: oldest, checked: -1}
+			c.mu.Unlock()
+		}
+
+		c.wg.Add(1)
+		go c.consume(pc)
+	}
+	return nil
+}
+
+func (c *offsetsTopicCollector) consume(pc sarama.PartitionConsumer) {
+	defer c.wg.Done()
+
+	for msg := range pc.Messages() {
+		if err := c.handleMessage(msg); err != nil {
+			logp.Debug("kafkabeat", "Skipping %s message at %d/%d: %v", offsetsTopic, msg.Partition, msg.Offset, err)
+		}
+	}
+}
+
+func (c *offsetsTopicCollector) Close() error {
+	for _, pc := range c.consumers {
+		pc.AsyncClose()
+	}
+	err := c.consumer.Close()
+	c.wg.Wait()
+	return err
+}
+
+// ready reports whether every partition has been read up to the end it had
+// when the collector started.
+func (c *offsetsTopicCollector) ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.pending) == 0
+}
+
+// checkPending is called once per period to mark the partitions which ended
+// in transaction markers as caught up.
+func (c *offsetsTopicCollector) checkPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for partition, p := range c.pending {
+		if p.caughtUp() {
+			delete(c.pending, partition)
+		}
+	}
+
+	if len(c.pending) > 0 {
+		logp.Info("Reading %s, %d partitions left. Fetching consumer offsets with OffsetFetch until done.", offsetsTopic, len(c.pending))
+	} else if !c.caught {
+		c.caught = true
+		logp.Info("Read %s, using it for consumer offsets", offsetsTopic)
+	}
+}
+
+func (c *offsetsTopicCollector) handleMessage(msg *sarama.ConsumerMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.pending[msg.Partition]; ok {
+		p.offset = msg.Offset + 1
+		if p.offset >= p.end {
+			delete(c.pending, msg.Partition)
+		}
+	}
+
+	key, err := decodeOffsetsTopicKey(msg.Key)
+	if err != nil {
+		return err
+	}
+
+	switch k := key.(type) {
+	case *offsetCommitKey:
+		pk := groupPartitionKey{k.Group, k.Topic, k.Partition}
+		if msg.Value == nil {
+			delete(c.offsets, pk)
+			return nil
+		}
+
+		offset, err := decodeOffsetCommitValue(msg.Value)
+		if err != nil {
+			return err
+		}
+		c.offsets[pk] = offset
+	case *groupMetadataKey:
+		if msg.Value == nil {
+			delete(c.groups, k.Group)
+			return nil
+		}
+
+		metadata, err := decodeGroupMetadataValue(msg.Value)
+		if err != nil {
+			return err
+		}
+		metadata.Group = k.Group
+		metadata.State = groupStateStable
+		if len(metadata.Members) == 0 {
+			metadata.State = groupStateEmpty
+		}
+		c.groups[k.Group] = &loggedGroup{metadata: metadata, partition: msg.Partition}
+	}
+	return nil
+}
+
+func (c *offsetsTopicCollector) fetchConsumerOffsets(group string, tp topicPartitions) partitionOffsets {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	offsets := make(partitionOffsets)
+	for topic, partitions := range tp {
+		offsets[topic] = make(partitionOffset)
+		for _, partition := range partitions {
+			if o, ok := c.offsets[groupPartitionKey{group, topic, partition}]; ok {
+				offsets[topic][partition] = o.Offset
+			} else {
+				offsets[topic][partition] = -1
+			}
+		}
+	}
+	return offsets
+}
+
+func (c *offsetsTopicCollector) commitTimestamp(group, topic string, partition int32) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	o, ok := c.offsets[groupPartitionKey{group, topic, partition}]
+	if !ok {
+		return time.Time{}, false
+	}
+	return o.Timestamp, true
+}
+
+// describeGroup returns a group as its coordinator last wrote it. Groups are
+// only written when a generation completes or the last member leaves, so
+// the state is either Stable or Empty.
+func (c *offsetsTopicCollector) describeGroup(client sarama.Client, group string) (*groupMetadata, error) {
+	c.mu.RLock()
+	g, ok := c.groups[group]
+	ready := len(c.pending) == 0
+	c.mu.RUnlock()
+	if !ready {
+		return nil, fmt.Errorf("%s not read yet", offsetsTopic)
+	}
+	if !ok {
+		return nil, fmt.Errorf("group %s not found in %s", group, offsetsTopic)
+	}
+
+	coordinator, err := client.Leader(offsetsTopic, g.partition)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := *g.metadata
+	metadata.Coordinator = coordinator.ID()
+	return &metadata, nil
+}
+
+type offsetsTopicDecoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (d *offsetsTopicDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.off+n > len(d.buf) {
+		d.err = sarama.ErrInsufficientData
+		return nil
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *offsetsTopicDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *offsetsTopicDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *offsetsTopicDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *offsetsTopicDecoder) string() string {
+	n := d.int16()
+	if d.err != nil || n == -1 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *offsetsTopicDecoder) bytes() []byte {
+	n := d.int32()
+	if d.err != nil || n == -1 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func timestampFromMillis(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func decodeOffsetsTopicKey(b []byte) (interface{}, error) {
+	d := &offsetsTopicDecoder{buf: b}
+
+	version := d.int16()
+	switch version {
+	case 0, 1:
+		key := &offsetCommitKey{
+			Group:     d.string(),
+			Topic:     d.string(),
+			Partition: d.int32(),
+		}
+		return key, d.err
+	case 2:
+		key := &groupMetadataKey{Group: d.string()}
+		return key, d.err
+	default:
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, fmt.Errorf("unknown key version %d", version)
+	}
+}
+
+func decodeOffsetCommitValue(b []byte) (*committedOffset, error) {
+	d := &offsetsTopicDecoder{buf: b}
+
+	version := d.int16()
+	if d.err == nil && (version < 0 || version > 3) {
+		return nil, fmt.Errorf("unknown offset commit value version %d", version)
+	}
+
+	value := &committedOffset{Offset: d.int64()}
+	if version >= 3 {
+		d.int32() // leader epoch
+	}
+	value.Metadata = d.string()
+	value.Timestamp = timestampFromMillis(d.int64())
+	if version == 1 {
+		d.int64() // expire timestamp
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return value, nil
+}
+
+func decodeGroupMetadataValue(b []byte) (*groupMetadata, error) {
+	d := &offsetsTopicDecoder{buf: b}
+
+	version := d.int16()
+	if d.err == nil && (version < 0 || version > 3) {
+		return nil, fmt.Errorf("unknown group metadata value version %d", version)
+	}
+
+	value := &groupMetadata{ProtocolType: d.string()}
+	d.int32() // generation
+	value.Protocol = d.string()
+	d.string() // leader
+	if version >= 2 {
+		d.int64() // current state timestamp
+	}
+
+	n := d.int32()
+	for i := int32(0); i < n && d.err == nil; i++ {
+		member := &groupMember{MemberID: d.string()}
+		if version >= 3 {
+			d.string() // group instance id
+		}
+		member.ClientID = d.string()
+		member.ClientHost = d.string()
+		if version >= 1 {
+			d.int32() // rebalance timeout
+		}
+		d.int32() // session timeout
+		d.bytes() // subscription
+		member.Assignment = d.bytes()
+
+		value.Members = append(value.Members, member)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return value, nil
+}
@@ -0,0 +1,283 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEncoder struct {
+	bytes.Buffer
+}
+
+func (e *testEncoder) int16(v int16) *testEncoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *testEncoder) int32(v int32) *testEncoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *testEncoder) int64(v int64) *testEncoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *testEncoder) string(v string) *testEncoder {
+	e.int16(int16(len(v)))
+	e.WriteString(v)
+	return e
+}
+
+func (e *testEncoder) bytes(v []byte) *testEncoder {
+	e.int32(int32(len(v)))
+	e.Write(v)
+	return e
+}
+
+func offsetCommitKeyBytes(group, topic string, partition int32) []byte {
+	e := &testEncoder{}
+	e.int16(1).string(group).string(topic).int32(partition)
+	return e.Bytes()
+}
+
+func TestDecodeOffsetsTopicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := decodeOffsetsTopicKey(offsetCommitKeyBytes("test", "test-topic", 3))
+	assert.NoError(err)
+	assert.Equal(&offsetCommitKey{Group: "test", Topic: "test-topic", Partition: 3}, key)
+
+	e := &testEncoder{}
+	key, err = decodeOffsetsTopicKey(e.int16(2).string("test").Bytes())
+	assert.NoError(err)
+	assert.Equal(&groupMetadataKey{Group: "test"}, key)
+
+	e = &testEncoder{}
+	_, err = decodeOffsetsTopicKey(e.int16(1).string("test").Bytes())
+	assert.Equal(sarama.ErrInsufficientData, err)
+
+	e = &testEncoder{}
+	_, err = decodeOffsetsTopicKey(e.int16(9).Bytes())
+	assert.Error(err)
+}
+
+func TestDecodeOffsetCommitValue(t *testing.T) {
+	ts := time.Unix(1462174414, 123000000)
+	ms := int64(1462174414123)
+	assert := assert.New(t)
+
+	values := map[int16][]byte{
+		0: (&testEncoder{}).int16(0).int64(42).string("meta").int64(ms).Bytes(),
+		1: (&testEncoder{}).int16(1).int64(42).string("meta").int64(ms).int64(ms + 1000).Bytes(),
+		2: (&testEncoder{}).int16(2).int64(42).string("meta").int64(ms).Bytes(),
+		3: (&testEncoder{}).int16(3).int64(42).int32(5).string("meta").int64(ms).Bytes(),
+	}
+
+	for version, b := range values {
+		value, err := decodeOffsetCommitValue(b)
+		assert.NoError(err, fmt.Sprintf("version %d", version))
+		assert.Equal(&committedOffset{Offset: 42, Metadata: "meta", Timestamp: ts}, value, fmt.Sprintf("version %d", version))
+	}
+}
+
+func TestDecodeGroupMetadataValue(t *testing.T) {
+	assert := assert.New(t)
+
+	for version := int16(0); version <= 3; version++ {
+		e := &testEncoder{}
+		e.int16(version).string("consumer").int32(7).string("range").string("member-1")
+		if version >= 2 {
+			e.int64(1462174414000)
+		}
+		e.int32(1).string("member-1")
+		if version >= 3 {
+			e.int16(-1)
+		}
+		e.string("client-1").string("/127.0.0.1")
+		if version >= 1 {
+			e.int32(60000)
+		}
+		e.int32(30000).bytes([]byte{1}).bytes([]byte{2, 3})
+
+		value, err := decodeGroupMetadataValue(e.Bytes())
+		assert.NoError(err, fmt.Sprintf("version %d", version))
+		assert.Equal(&groupMetadata{
+			ProtocolType: "consumer",
+			Protocol:     "range",
+			Members: []*groupMember{{
+				MemberID:   "member-1",
+				ClientID:   "client-1",
+				ClientHost: "/127.0.0.1",
+				Assignment: []byte{2, 3},
+			}},
+		}, value, fmt.Sprintf("version %d", version))
+	}
+}
+
+func TestOffsetsTopicCollectorHandleMessage(t *testing.T) {
+	c := &offsetsTopicCollector{
+		offsets: make(map[groupPartitionKey]*committedOffset),
+		groups:  make(map[string]*loggedGroup),
+		pending: map[int32]*pendingPartition{0: {end: 2}},
+	}
+
+	value := (&testEncoder{}).int16(1).int64(42).string("").int64(1462174414000).int64(0).Bytes()
+	err := c.handleMessage(&sarama.ConsumerMessage{
+		Partition: 0,
+		Offset:    0,
+		Key:       offsetCommitKeyBytes("test", "test-topic", 0),
+		Value:     value,
+	})
+
+	assert := assert.New(t)
+	assert.NoError(err)
+	assert.False(c.ready())
+
+	offsets := c.fetchConsumerOffsets("test", topicPartitions{"test-topic": {0, 1}})
+	assert.Equal(partitionOffsets{"test-topic": {0: 42, 1: -1}}, offsets)
+
+	ts, ok := c.commitTimestamp("test", "test-topic", 0)
+	assert.True(ok)
+	assert.Equal(time.Unix(1462174414, 0), ts)
+
+	err = c.handleMessage(&sarama.ConsumerMessage{
+		Partition: 0,
+		Offset:    1,
+		Key:       offsetCommitKeyBytes("test", "test-topic", 0),
+	})
+	assert.NoError(err)
+	assert.True(c.ready())
+
+	_, ok = c.commitTimestamp("test", "test-topic", 0)
+	assert.False(ok)
+}
+
+func groupMetadataValueBytes(members ...string) []byte {
+	e := &testEncoder{}
+	e.int16(0).string("consumer").int32(1).string("range").string("")
+	e.int32(int32(len(members)))
+	for _, member := range members {
+		e.string(member).string("client-1").string("/127.0.0.1").int32(30000).bytes(nil).bytes(nil)
+	}
+	return e.Bytes()
+}
+
+func TestOffsetsTopicCollectorGroups(t *testing.T) {
+	c := &offsetsTopicCollector{
+		offsets: make(map[groupPartitionKey]*committedOffset),
+		groups:  make(map[string]*loggedGroup),
+		pending: make(map[int32]*pendingPartition),
+	}
+	groupKey := (&testEncoder{}).int16(2).string("test").Bytes()
+
+	assert := assert.New(t)
+	for _, value := range [][]byte{groupMetadataValueBytes("member-1"), groupMetadataValueBytes()} {
+		assert.NoError(c.handleMessage(&sarama.ConsumerMessage{Partition: 1, Key: groupKey, Value: value}))
+	}
+	g := c.groups["test"]
+	assert.Equal(int32(1), g.partition)
+	assert.Equal("test", g.metadata.Group)
+	assert.Equal(groupStateEmpty, g.metadata.State)
+	assert.Empty(g.metadata.Members)
+
+	assert.NoError(c.handleMessage(&sarama.ConsumerMessage{Partition: 1, Key: groupKey}))
+	assert.Empty(c.groups)
+}
+
+// testPartitionConsumer only reports a high water mark, like a consumer
+// which has fetched a partition ending in transaction markers.
+type testPartitionConsumer struct {
+	sarama.PartitionConsumer
+	highWaterMark int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+func (pc *testPartitionConsumer) HighWaterMarkOffset() int64 {
+	return pc.highWaterMark
+}
+
+func (pc *testPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return pc.messages
+}
+
+func TestPendingPartitionCaughtUp(t *testing.T) {
+	pc := &testPartitionConsumer{highWaterMark: 5, messages: make(chan *sarama.ConsumerMessage, 1)}
+	p := &pendingPartition{consumer: pc, end: 5, offset: 3, checked: -1}
+
+	assert := assert.New(t)
+	assert.False(p.caughtUp())
+
+	pc.messages <- &sarama.ConsumerMessage{}
+	assert.False(p.caughtUp())
+
+	<-pc.messages
+	p.offset = 4
+	assert.False(p.caughtUp())
+	assert.True(p.caughtUp())
+
+	p = &pendingPartition{consumer: pc, end: 6, offset: 4, checked: 4}
+	assert.False(p.caughtUp())
+}
+
+func TestOffsetsTopicCollectorStart(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	// The log ends with a transaction marker at offset 2, which the
+	// consumer skips.
+	fetch := &sarama.FetchResponse{Version: 1}
+	fetch.AddMessage(offsetsTopic, 0, sarama.ByteEncoder(offsetCommitKeyBytes("test", "test-topic", 0)),
+		sarama.ByteEncoder((&testEncoder{}).int16(1).int64(42).string("").int64(1462174414000).int64(0).Bytes()), 0)
+	fetch.AddMessage(offsetsTopic, 0, sarama.ByteEncoder((&testEncoder{}).int16(2).string("test").Bytes()),
+		sarama.ByteEncoder(groupMetadataValueBytes("member-1")), 1)
+	fetch.GetBlock(offsetsTopic, 0).HighWaterMarkOffset = 3
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(offsetsTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(offsetsTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(offsetsTopic, 0, sarama.OffsetNewest, 3),
+		"FetchRequest": sarama.NewMockWrapper(fetch),
+	})
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = sarama.V0_9_0_0
+	saramaConfig.Consumer.MaxWaitTime = 10 * time.Millisecond
+	client, err := sarama.NewClient([]string{broker.Addr()}, saramaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	c, err := newOffsetsTopicCollector(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, c)
+
+	assert := assert.New(t)
+	assert.False(c.ready())
+	assert.Eventually(func() bool {
+		c.checkPending()
+		return c.ready()
+	}, time.Second, 20*time.Millisecond)
+
+	offsets := c.fetchConsumerOffsets("test", topicPartitions{"test-topic": {0}})
+	assert.Equal(partitionOffsets{"test-topic": {0: 42}}, offsets)
+
+	metadata, err := c.describeGroup(client, "test")
+	assert.NoError(err)
+	assert.Equal(groupStateStable, metadata.State)
+	assert.Equal(broker.BrokerID(), metadata.Coordinator)
+	assert.Equal("member-1", metadata.Members[0].MemberID)
+}
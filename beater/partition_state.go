@@ -0,0 +1,218 @@
+package beater
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const minInsyncReplicasConfig = "min.insync.replicas"
+
+// PartitionState is the replication state of a partition as seen in the
+// cluster metadata.
+type PartitionState struct {
+	Topic              string
+	Partition          int32
+	Leader             int32
+	Replicas           []int32
+	ISR                []int32
+	OfflineReplicas    []int32
+	HasOfflineReplicas bool
+	MinISR             int
+	Err                error
+}
+
+func (s *PartitionState) underReplicated() bool {
+	return len(s.ISR) < len(s.Replicas)
+}
+
+func (s *PartitionState) underMinISR() bool {
+	return len(s.ISR) < s.MinISR
+}
+
+// preferredLeader reports whether the partition is led by the first replica,
+// which is where Kafka moves leadership back to on a preferred election.
+func (s *PartitionState) preferredLeader() bool {
+	return len(s.Replicas) > 0 && s.Leader == s.Replicas[0]
+}
+
+func (s *PartitionState) event() common.MapStr {
+	if s.Err != nil {
+		return common.MapStr{
+			"topic":     s.Topic,
+			"partition": s.Partition,
+			"error":     errorFields(s.Err),
+		}
+	}
+
+	event := common.MapStr{
+		"topic":            s.Topic,
+		"partition":        s.Partition,
+		"replicas":         s.Replicas,
+		"isr":              s.ISR,
+		"under_replicated": s.underReplicated(),
+		"preferred_leader": s.preferredLeader(),
+	}
+	if s.Leader >= 0 {
+		event["leader"] = s.Leader
+	}
+	if s.HasOfflineReplicas {
+		event["offline_replicas"] = s.OfflineReplicas
+	}
+	if s.MinISR > 0 {
+		event["min_insync_replicas"] = s.MinISR
+		event["under_min_isr"] = s.underMinISR()
+	}
+	return event
+}
+
+func partitionsOf(offsets []*Offset) topicPartitions {
+	tp := make(topicPartitions)
+	seen := make(map[partitionKey]bool)
+	for _, o := range offsets {
+		// Topics that failed as a whole are reported without partitions.
+		if o.Partition < 0 {
+			continue
+		}
+		key := partitionKey{o.Topic, o.Partition}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		tp[o.Topic] = append(tp[o.Topic], o.Partition)
+	}
+	return tp
+}
+
+func (c *KafkaClient) getPartitionEvents(tp topicPartitions, now time.Time) []common.MapStr {
+	var events []common.MapStr
+
+	for _, s := range c.fetchPartitionStates(tp) {
+		events = append(events, common.MapStr{
+			"@timestamp": common.Time(now),
+			"type":       "partition",
+			"partition":  s.event(),
+		})
+	}
+	return events
+}
+
+func (c *KafkaClient) fetchPartitionStates(tp topicPartitions) []*PartitionState {
+	topics := tp.topics()
+
+	// The cached metadata is only refreshed every metadata.refresh_frequency,
+	// replicas falling out of sync should show up within a period.
+	if len(topics) > 0 {
+		if err := c.client.RefreshMetadata(topics...); err != nil {
+			logp.Warn("Failed to refresh metadata of topics: %v", err)
+		}
+	}
+
+	minISR, err := c.fetchMinISR(topics)
+	if err != nil {
+		logp.Warn("Failed to read %s of topics: %v", minInsyncReplicasConfig, err)
+	}
+
+	var states []*PartitionState
+	for _, topic := range topics {
+		for _, partition := range tp[topic] {
+			s := &PartitionState{
+				Topic:     topic,
+				Partition: partition,
+				Leader:    -1,
+				MinISR:    minISR[topic],
+			}
+
+			if broker, err := c.client.Leader(topic, partition); err == nil {
+				s.Leader = broker.ID()
+			}
+
+			s.Err = c.readReplicas(s)
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+func (c *KafkaClient) readReplicas(s *PartitionState) error {
+	var err error
+
+	// ErrReplicaNotAvailable comes along with the replicas that are known.
+	if s.Replicas, err = c.client.Replicas(s.Topic, s.Partition); err != nil && err != sarama.ErrReplicaNotAvailable {
+		return err
+	}
+	if s.ISR, err = c.client.InSyncReplicas(s.Topic, s.Partition); err != nil && err != sarama.ErrReplicaNotAvailable {
+		return err
+	}
+
+	// Offline replicas are only in metadata from version 5, which sarama
+	// requests from kafka_version 1.0.
+	if c.kafkaVersion.IsAtLeast(sarama.V1_0_0_0) {
+		if s.OfflineReplicas, err = c.client.OfflineReplicas(s.Topic, s.Partition); err != nil && err != sarama.ErrReplicaNotAvailable {
+			return err
+		}
+		s.HasOfflineReplicas = true
+	}
+	return nil
+}
+
+// fetchMinISR reads min.insync.replicas of the topics with DescribeConfigs,
+// which any broker can answer. sarama only sends it from kafka_version 0.11.
+func (c *KafkaClient) fetchMinISR(topics []string) (map[string]int, error) {
+	if len(topics) == 0 || !c.kafkaVersion.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, nil
+	}
+
+	request := &sarama.DescribeConfigsRequest{}
+	for _, topic := range topics {
+		request.Resources = append(request.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        topic,
+			ConfigNames: []string{minInsyncReplicasConfig},
+		})
+	}
+
+	var lastErr error = sarama.ErrOutOfBrokers
+	for _, broker := range c.client.Brokers() {
+		if ok, _ := broker.Connected(); !ok {
+			if err := broker.Open(c.client.Config()); err != nil && err != sarama.ErrAlreadyConnected {
+				lastErr = err
+				continue
+			}
+		}
+
+		response, err := broker.DescribeConfigs(request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return parseMinISR(response), nil
+	}
+	return nil, lastErr
+}
+
+func parseMinISR(response *sarama.DescribeConfigsResponse) map[string]int {
+	minISR := make(map[string]int)
+	for _, resource := range response.Resources {
+		if resource.ErrorCode != int16(sarama.ErrNoError) {
+			logp.Warn("Failed to describe topic %s: %v", resource.Name, sarama.KError(resource.ErrorCode))
+			continue
+		}
+
+		for _, entry := range resource.Configs {
+			if entry.Name != minInsyncReplicasConfig {
+				continue
+			}
+			value, err := strconv.Atoi(entry.Value)
+			if err != nil {
+				logp.Warn("Invalid %s of topic %s: %q", minInsyncReplicasConfig, resource.Name, entry.Value)
+				continue
+			}
+			minISR[resource.Name] = value
+		}
+	}
+	return minISR
+}
@@ -0,0 +1,174 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func TestPartitionStateEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &PartitionState{
+		Topic:              "test-topic",
+		Partition:          0,
+		Leader:             2,
+		Replicas:           []int32{1, 2, 3},
+		ISR:                []int32{2, 3},
+		OfflineReplicas:    []int32{1},
+		HasOfflineReplicas: true,
+		MinISR:             3,
+	}
+	event := s.event()
+	assert.Equal(int32(2), event["leader"])
+	assert.Equal([]int32{1}, event["offline_replicas"])
+	assert.Equal(true, event["under_replicated"])
+	assert.Equal(true, event["under_min_isr"])
+	assert.Equal(false, event["preferred_leader"])
+
+	s = &PartitionState{
+		Topic:     "test-topic",
+		Partition: 1,
+		Leader:    -1,
+		Replicas:  []int32{1},
+		ISR:       []int32{1},
+	}
+	event = s.event()
+	assert.NotContains(event, "leader")
+	assert.NotContains(event, "offline_replicas")
+	assert.NotContains(event, "under_min_isr")
+	assert.Equal(false, event["under_replicated"])
+	assert.Equal(false, event["preferred_leader"])
+
+	s = &PartitionState{Topic: "test-topic", Partition: 2, Err: sarama.ErrUnknownTopicOrPartition}
+	event = s.event()
+	assert.Equal(int16(sarama.ErrUnknownTopicOrPartition), event["error"].(common.MapStr)["code"])
+	assert.NotContains(event, "replicas")
+}
+
+func TestPartitionsOf(t *testing.T) {
+	offsets := []*Offset{
+		{Group: "a", Topic: "t1", Partition: 0},
+		{Group: "a", Topic: "t1", Partition: 1},
+		{Group: "b", Topic: "t1", Partition: 0},
+		{Group: "b", Topic: "t2", Partition: 0},
+	}
+	assert.Equal(t, topicPartitions{"t1": {0, 1}, "t2": {0}}, partitionsOf(offsets))
+}
+
+func TestParseMinISR(t *testing.T) {
+	response := &sarama.DescribeConfigsResponse{
+		Resources: []*sarama.ResourceResponse{
+			{
+				Name:    "t1",
+				Configs: []*sarama.ConfigEntry{{Name: minInsyncReplicasConfig, Value: "2"}},
+			},
+			{
+				ErrorCode: int16(sarama.ErrUnknownTopicOrPartition),
+				Name:      "t2",
+			},
+			{
+				Name:    "t3",
+				Configs: []*sarama.ConfigEntry{{Name: minInsyncReplicasConfig, Value: "x"}},
+			},
+		},
+	}
+	assert.Equal(t, map[string]int{"t1": 2}, parseMinISR(response))
+}
+
+func TestFetchMinISRVersion(t *testing.T) {
+	// DescribeConfigs isn't sent below 0.11, the client isn't used.
+	c := &KafkaClient{kafkaVersion: sarama.V0_10_2_0}
+	minISR, err := c.fetchMinISR([]string{"t1"})
+	assert.NoError(t, err)
+	assert.Nil(t, minISR)
+}
+
+func TestGetOffsetEventsPartitionEvents(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 2)
+
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 3}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 3}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 220})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 2}))
+	for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+		leader.Returns(&sarama.OffsetResponse{
+			Version: 2,
+			Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+				"test-topic": {
+					0: {Err: sarama.ErrNoError, Offset: offsets[0], Timestamp: -1},
+					1: {Err: sarama.ErrNoError, Offset: offsets[1], Timestamp: -1},
+				},
+			},
+		})
+	}
+
+	// The metadata is refreshed for the partition events: a replica of
+	// partition 0 fell out of sync and partition 1 is gone. sarama refreshes
+	// again when looking up the leader and the replicas of partition 1.
+	refreshed := &sarama.MetadataResponse{Version: 1}
+	refreshed.AddBroker(leader.Addr(), leader.BrokerID())
+	refreshed.AddTopicPartition("test-topic", 0, leader.BrokerID(), []int32{3, 4}, []int32{3}, nil, sarama.ErrNoError)
+	for i := 0; i < 3; i++ {
+		seedBroker.Returns(refreshed)
+	}
+
+	leader.Returns(&sarama.DescribeConfigsResponse{
+		Resources: []*sarama.ResourceResponse{{
+			Name:    "test-topic",
+			Configs: []*sarama.ConfigEntry{{Name: minInsyncReplicasConfig, Value: "2"}},
+		}},
+	})
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:           []string{seedBroker.Addr()},
+		ConsumerGroup:   "test",
+		Topics:          []string{"test-topic"},
+		KafkaVersion:    "0.11.0.0",
+		PartitionEvents: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	var partitions []common.MapStr
+	for _, event := range events {
+		if event["type"] == "partition" {
+			partitions = append(partitions, event["partition"].(common.MapStr))
+		}
+	}
+	if assert.Len(partitions, 2) {
+		p0 := partitions[0]
+		assert.Equal(int32(0), p0["partition"])
+		assert.Equal([]int32{3, 4}, p0["replicas"])
+		assert.Equal([]int32{3}, p0["isr"])
+		assert.Equal(true, p0["under_replicated"])
+		assert.Equal(2, p0["min_insync_replicas"])
+		assert.Equal(true, p0["under_min_isr"])
+
+		p1 := partitions[1]
+		assert.Equal(int32(1), p1["partition"])
+		assert.Equal(int16(sarama.ErrUnknownTopicOrPartition), p1["error"].(common.MapStr)["code"])
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
@@ -0,0 +1,118 @@
+package beater
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+// configureSASL sets up SASL authentication with the mechanism and the
+// credentials of the sasl section. With OAUTHBEARER the username and the
+// password are the client credentials used to get tokens.
+func configureSASL(saramaConfig *sarama.Config, conf *config.SASLConfig) error {
+	password, err := saslPassword(conf)
+	if err != nil {
+		return err
+	}
+
+	saramaConfig.Net.SASL.Enable = true
+	saramaConfig.Net.SASL.Handshake = true
+	saramaConfig.Net.SASL.User = conf.Username
+	saramaConfig.Net.SASL.Password = password
+
+	// SaslAuthenticate was added in Kafka 1.0, older brokers only take PLAIN
+	// credentials sent after a version 0 handshake.
+	saramaConfig.Net.SASL.Version = sarama.SASLHandshakeV1
+	mechanism := strings.ToUpper(conf.Mechanism)
+	if !saramaConfig.Version.IsAtLeast(sarama.V1_0_0_0) {
+		if mechanism != "" && mechanism != sarama.SASLTypePlaintext {
+			return fmt.Errorf("sasl.mechanism %s requires kafka_version 1.0.0 or later", conf.Mechanism)
+		}
+		saramaConfig.Net.SASL.Version = sarama.SASLHandshakeV0
+	}
+
+	switch mechanism {
+	case "", sarama.SASLTypePlaintext:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512.New}
+		}
+	case sarama.SASLTypeOAuth:
+		if conf.TokenURL == "" {
+			return errors.New("sasl.token_url is required by OAUTHBEARER")
+		}
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		saramaConfig.Net.SASL.TokenProvider = newOAuthTokenProvider(conf.TokenURL, conf.Username, password, conf.Scopes)
+	default:
+		return fmt.Errorf("Invalid sasl.mechanism %q", conf.Mechanism)
+	}
+	return nil
+}
+
+func saslPassword(conf *config.SASLConfig) (string, error) {
+	sources := 0
+	for _, s := range []string{conf.Password, conf.PasswordFile, conf.PasswordEnv} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", errors.New("only one of sasl.password, sasl.password_file and sasl.password_env can be set")
+	}
+
+	switch {
+	case conf.PasswordFile != "":
+		data, err := ioutil.ReadFile(conf.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case conf.PasswordEnv != "":
+		password, ok := os.LookupEnv(conf.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", conf.PasswordEnv)
+		}
+		return password, nil
+	default:
+		return conf.Password, nil
+	}
+}
+
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (x *scramClient) Begin(userName, password, authzID string) (err error) {
+	x.Client, err = x.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	x.ClientConversation = x.Client.NewConversation()
+	return nil
+}
+
+func (x *scramClient) Step(challenge string) (string, error) {
+	return x.ClientConversation.Step(challenge)
+}
+
+func (x *scramClient) Done() bool {
+	return x.ClientConversation.Done()
+}
@@ -0,0 +1,110 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func TestSASLPassword(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "kafkabeat-sasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("from-file\n")
+	file.Close()
+
+	password, err := saslPassword(&config.SASLConfig{PasswordFile: file.Name()})
+	assert.NoError(err)
+	assert.Equal("from-file", password)
+
+	os.Setenv("KAFKABEAT_TEST_SASL_PASSWORD", "from-env")
+	defer os.Unsetenv("KAFKABEAT_TEST_SASL_PASSWORD")
+
+	password, err = saslPassword(&config.SASLConfig{PasswordEnv: "KAFKABEAT_TEST_SASL_PASSWORD"})
+	assert.NoError(err)
+	assert.Equal("from-env", password)
+
+	_, err = saslPassword(&config.SASLConfig{PasswordEnv: "KAFKABEAT_TEST_SASL_MISSING"})
+	assert.Error(err)
+
+	_, err = saslPassword(&config.SASLConfig{Password: "secret", PasswordFile: file.Name()})
+	assert.Error(err)
+}
+
+func TestConfigureSASL(t *testing.T) {
+	assert := assert.New(t)
+
+	saramaConfig, err := newSaramaConfig(&config.KafkabeatConfig{
+		SASL: config.SASLConfig{
+			Mechanism: "scram-sha-512",
+			Username:  "user",
+			Password:  "secret",
+		},
+	})
+	assert.NoError(err)
+	assert.True(saramaConfig.Net.SASL.Enable)
+	assert.Equal(sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), saramaConfig.Net.SASL.Mechanism)
+	assert.NotNil(saramaConfig.Net.SASL.SCRAMClientGeneratorFunc)
+	assert.Equal(sarama.SASLHandshakeV1, saramaConfig.Net.SASL.Version)
+	assert.True(saramaConfig.Version.IsAtLeast(sarama.V1_0_0_0))
+
+	// PLAIN works with brokers older than 1.0, without SaslAuthenticate.
+	saramaConfig, err = newSaramaConfig(&config.KafkabeatConfig{
+		KafkaVersion: "0.10.2.0",
+		SASL:         config.SASLConfig{Username: "user", Password: "secret"},
+	})
+	assert.NoError(err)
+	assert.Equal(sarama.SASLHandshakeV0, saramaConfig.Net.SASL.Version)
+	assert.False(saramaConfig.Version.IsAtLeast(sarama.V1_0_0_0))
+
+	_, err = newSaramaConfig(&config.KafkabeatConfig{
+		KafkaVersion: "0.10.2.0",
+		SASL:         config.SASLConfig{Mechanism: "SCRAM-SHA-256", Username: "user"},
+	})
+	assert.Error(err)
+
+	saramaConfig = sarama.NewConfig()
+	saramaConfig.Version = sarama.V1_0_0_0
+	err = configureSASL(saramaConfig, &config.SASLConfig{Mechanism: "GSSAPI", Username: "user"})
+	assert.Error(err)
+
+	err = configureSASL(saramaConfig, &config.SASLConfig{Mechanism: "OAUTHBEARER", Username: "client"})
+	assert.Error(err)
+}
+
+func TestNewKafkaClientSASL(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	seedBroker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"SaslHandshakeRequest": sarama.NewMockSaslHandshakeResponse(t).
+			SetEnabledMechanisms([]string{sarama.SASLTypePlaintext}),
+		"SaslAuthenticateRequest": sarama.NewMockSaslAuthenticateResponse(t),
+	})
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		SASL: config.SASLConfig{
+			Mechanism: "PLAIN",
+			Username:  "user",
+			Password:  "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedBroker.Close()
+	safeClose(t, client)
+}
@@ -0,0 +1,261 @@
+package beater
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// recordFetchBytes is enough for the batch holding the record in most cases,
+// brokers return a larger first batch whole anyway from version 3.
+const recordFetchBytes int32 = 64 * 1024
+
+type recordKey struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+// timestampCache keeps the timestamps of the records at the committed offsets
+// and at the log ends, fetched at most maxFetches at a time. A timestamp is
+// kept for as long as its offset is still used, so a committed offset that
+// doesn't move is fetched only once.
+type timestampCache struct {
+	maxFetches int
+	timestamps map[recordKey]time.Time
+	next       int
+}
+
+func newTimestampCache(maxFetches int) *timestampCache {
+	return &timestampCache{
+		maxFetches: maxFetches,
+		timestamps: make(map[recordKey]time.Time),
+	}
+}
+
+// schedule picks the records to fetch this period. Partitions are only picked
+// when both of their records can be fetched, starting after the last picked
+// one in the previous period so every partition eventually gets its turn.
+func (t *timestampCache) schedule(pending []*Offset) map[recordKey]bool {
+	fetch := make(map[recordKey]bool)
+	if len(pending) == 0 {
+		return fetch
+	}
+
+	budget := t.maxFetches
+	start := t.next % len(pending)
+	for i := range pending {
+		o := pending[(start+i)%len(pending)]
+
+		var missing []recordKey
+		for _, key := range o.recordKeys() {
+			if _, ok := t.timestamps[key]; !ok && !fetch[key] {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > budget {
+			continue
+		}
+
+		budget -= len(missing)
+		for _, key := range missing {
+			fetch[key] = true
+		}
+		if len(missing) > 0 {
+			t.next = start + i + 1
+		}
+	}
+	return fetch
+}
+
+// prune drops the timestamps of the offsets that are no longer used.
+func (t *timestampCache) prune(used map[recordKey]bool) {
+	for key := range t.timestamps {
+		if !used[key] {
+			delete(t.timestamps, key)
+		}
+	}
+}
+
+// recordKeys are the record at the committed offset, the next one the group
+// consumes, and the last record of the partition.
+func (o *Offset) recordKeys() []recordKey {
+	committed := recordKey{o.Topic, o.Partition, o.ConsumerOffset}
+	end := recordKey{o.Topic, o.Partition, o.BrokerOffset}
+	if committed == end {
+		return []recordKey{committed}
+	}
+	return []recordKey{committed, end}
+}
+
+// sampleTimestampLag sets the time lag of the committed partitions, the time
+// between the record the group consumes next and the last record.
+func (c *KafkaClient) sampleTimestampLag(offsets []*Offset) {
+	used := make(map[recordKey]bool)
+	var pending []*Offset
+	for _, o := range offsets {
+		if o.Err != nil || !o.Committed {
+			continue
+		}
+		if o.ConsumerOffset > o.BrokerOffset {
+			o.LagMs, o.HasLagMs = 0, true
+			continue
+		}
+
+		for _, key := range o.recordKeys() {
+			used[key] = true
+		}
+		pending = append(pending, o)
+	}
+
+	fetch := c.timestamps.schedule(pending)
+	for key, timestamp := range c.fetchRecordTimestamps(fetch) {
+		c.timestamps.timestamps[key] = timestamp
+	}
+	c.timestamps.prune(used)
+
+	for _, o := range pending {
+		keys := o.recordKeys()
+		committed, ok := c.timestamps.timestamps[keys[0]]
+		if !ok {
+			continue
+		}
+		end, ok := c.timestamps.timestamps[keys[len(keys)-1]]
+		if !ok {
+			continue
+		}
+		o.LagMs, o.HasLagMs = positiveNum(int64(end.Sub(committed)/time.Millisecond)), true
+	}
+}
+
+// fetchRecordTimestamps fetches the records from the partition leaders. A
+// fetch request reads a partition at one offset only, the records of the same
+// partition are spread over several rounds.
+func (c *KafkaClient) fetchRecordTimestamps(keys map[recordKey]bool) map[recordKey]time.Time {
+	partitionOffsets := make(map[partitionKey][]int64)
+	for key := range keys {
+		pk := partitionKey{key.topic, key.partition}
+		partitionOffsets[pk] = append(partitionOffsets[pk], key.offset)
+	}
+	for _, offsets := range partitionOffsets {
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	}
+
+	timestamps := make(map[recordKey]time.Time)
+	for len(partitionOffsets) > 0 {
+		requests := make(map[*sarama.Broker]*sarama.FetchRequest)
+		requested := make(map[*sarama.Broker][]recordKey)
+
+		for pk, offsets := range partitionOffsets {
+			key := recordKey{pk.topic, pk.partition, offsets[0]}
+			if len(offsets) == 1 {
+				delete(partitionOffsets, pk)
+			} else {
+				partitionOffsets[pk] = offsets[1:]
+			}
+
+			broker, err := c.client.Leader(pk.topic, pk.partition)
+			if err != nil {
+				logp.Debug("kafkabeat", "Failed to find leader of %s/%d: %v", pk.topic, pk.partition, err)
+				continue
+			}
+			request, ok := requests[broker]
+			if !ok {
+				request = c.newRecordFetchRequest(broker)
+				if request == nil {
+					continue
+				}
+				requests[broker] = request
+			}
+			request.AddBlock(key.topic, key.partition, key.offset, recordFetchBytes)
+			requested[broker] = append(requested[broker], key)
+		}
+
+		for broker, request := range requests {
+			response, err := broker.Fetch(request)
+			if err != nil {
+				logp.Warn("Failed to fetch records from broker %s: %v", broker.Addr(), err)
+				c.forgetVersions(broker)
+				continue
+			}
+
+			for _, key := range requested[broker] {
+				block := response.GetBlock(key.topic, key.partition)
+				if block == nil || block.Err != sarama.ErrNoError {
+					continue
+				}
+				if timestamp, ok := recordTimestamp(block, key.offset); ok {
+					timestamps[key] = timestamp
+				}
+			}
+		}
+	}
+	return timestamps
+}
+
+// newRecordFetchRequest returns nil when the broker only supports fetch
+// versions without timestamps.
+func (c *KafkaClient) newRecordFetchRequest(broker *sarama.Broker) *sarama.FetchRequest {
+	version := c.requestVersion(broker, apiKeyFetch)
+	if version < 2 {
+		logp.Debug("kafkabeat", "Broker %s doesn't return record timestamps", broker.Addr())
+		return nil
+	}
+
+	request := &sarama.FetchRequest{
+		Version:     version,
+		MaxWaitTime: 100,
+		MinBytes:    1,
+	}
+	if version >= 3 {
+		request.MaxBytes = sarama.MaxResponseSize
+	}
+	return request
+}
+
+// recordTimestamp is the timestamp of the first record at or after offset,
+// the batch holding the record may start before it. Records written before
+// Kafka 0.10 have no timestamp.
+func recordTimestamp(block *sarama.FetchResponseBlock, offset int64) (time.Time, bool) {
+	for _, records := range block.RecordsSet {
+		if batch := records.RecordBatch; batch != nil {
+			for _, r := range batch.Records {
+				if batch.FirstOffset+r.OffsetDelta < offset {
+					continue
+				}
+				timestamp := batch.FirstTimestamp.Add(r.TimestampDelta)
+				if batch.LogAppendTime {
+					timestamp = batch.MaxTimestamp
+				}
+				return timestamp, !timestamp.IsZero()
+			}
+		}
+
+		if set := records.MsgSet; set != nil {
+			for _, mb := range set.Messages {
+				messages := mb.Messages()
+
+				// Messages compressed together have offsets relative to the
+				// offset of the last one from format version 1.
+				var base int64
+				if mb.Msg.Set != nil && mb.Msg.Version >= 1 && len(messages) > 0 {
+					base = mb.Offset - messages[len(messages)-1].Offset
+				}
+
+				for _, m := range messages {
+					if base+m.Offset < offset {
+						continue
+					}
+					timestamp := m.Msg.Timestamp
+					if mb.Msg.LogAppendTime {
+						timestamp = mb.Msg.Timestamp
+					}
+					return timestamp, !timestamp.IsZero()
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
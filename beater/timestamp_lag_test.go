@@ -0,0 +1,223 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+func TestTimestampCacheSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	pending := []*Offset{
+		{Topic: "t", Partition: 0, ConsumerOffset: 10, BrokerOffset: 20},
+		{Topic: "t", Partition: 1, ConsumerOffset: 10, BrokerOffset: 20},
+		{Topic: "t", Partition: 2, ConsumerOffset: 20, BrokerOffset: 20},
+	}
+
+	cache := newTimestampCache(3)
+	fetch := cache.schedule(pending)
+	assert.Equal(map[recordKey]bool{
+		{"t", 0, 10}: true,
+		{"t", 0, 20}: true,
+		{"t", 2, 20}: true,
+	}, fetch)
+
+	for key := range fetch {
+		cache.timestamps[key] = time.Now()
+	}
+
+	// The committed offset of partition 0 didn't move, only its log end is
+	// fetched again, and partition 1 gets its turn.
+	pending[0].BrokerOffset = 25
+	fetch = cache.schedule(pending)
+	assert.Equal(map[recordKey]bool{
+		{"t", 1, 10}: true,
+		{"t", 1, 20}: true,
+		{"t", 0, 25}: true,
+	}, fetch)
+
+	cache.prune(map[recordKey]bool{{"t", 0, 10}: true})
+	assert.Len(cache.timestamps, 1)
+}
+
+func TestRecordTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	first := time.Unix(1000, 0)
+	batch := &sarama.RecordBatch{
+		FirstOffset:    10,
+		FirstTimestamp: first,
+		MaxTimestamp:   first.Add(2 * time.Second),
+		Records: []*sarama.Record{
+			{OffsetDelta: 0},
+			{OffsetDelta: 1, TimestampDelta: time.Second},
+			{OffsetDelta: 2, TimestampDelta: 2 * time.Second},
+		},
+	}
+	block := &sarama.FetchResponseBlock{RecordsSet: []*sarama.Records{{RecordBatch: batch}}}
+
+	timestamp, ok := recordTimestamp(block, 11)
+	assert.True(ok)
+	assert.Equal(first.Add(time.Second), timestamp)
+
+	_, ok = recordTimestamp(block, 13)
+	assert.False(ok)
+
+	batch.LogAppendTime = true
+	timestamp, _ = recordTimestamp(block, 11)
+	assert.Equal(first.Add(2*time.Second), timestamp)
+
+	// Compressed messages with offsets relative to the wrapper.
+	wrapper := &sarama.MessageBlock{
+		Offset: 21,
+		Msg: &sarama.Message{
+			Version: 1,
+			Set: &sarama.MessageSet{Messages: []*sarama.MessageBlock{
+				{Offset: 0, Msg: &sarama.Message{Version: 1, Timestamp: first}},
+				{Offset: 1, Msg: &sarama.Message{Version: 1, Timestamp: first.Add(time.Second)}},
+			}},
+		},
+	}
+	block = &sarama.FetchResponseBlock{RecordsSet: []*sarama.Records{
+		{MsgSet: &sarama.MessageSet{Messages: []*sarama.MessageBlock{wrapper}}},
+	}}
+
+	timestamp, ok = recordTimestamp(block, 21)
+	assert.True(ok)
+	assert.Equal(first.Add(time.Second), timestamp)
+
+	// Messages written before 0.10 have no timestamp.
+	block = &sarama.FetchResponseBlock{RecordsSet: []*sarama.Records{
+		{MsgSet: &sarama.MessageSet{Messages: []*sarama.MessageBlock{{Offset: 5, Msg: &sarama.Message{}}}}},
+	}}
+	_, ok = recordTimestamp(block, 5)
+	assert.False(ok)
+}
+
+func TestGetOffsetEventsTimestampLag(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 1)
+
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 1}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 1}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 90})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 1, apiKeyFetch: 4}))
+	for _, offset := range []int64{101, 0} {
+		leader.Returns(&sarama.OffsetResponse{
+			Version: 1,
+			Blocks: map[string]map[int32]*sarama.OffsetResponseBlock{
+				"test-topic": {0: {Err: sarama.ErrNoError, Offset: offset, Timestamp: -1}},
+			},
+		})
+	}
+
+	// The record at the committed offset, then the last one.
+	committedAt := time.Unix(1000, 0)
+	for _, r := range []struct {
+		offset    int64
+		timestamp time.Time
+	}{
+		{90, committedAt},
+		{100, committedAt.Add(4500 * time.Millisecond)},
+	} {
+		fetchRes := &sarama.FetchResponse{Version: 4}
+		fetchRes.AddRecordWithTimestamp("test-topic", 0, nil, sarama.StringEncoder("value"), r.offset, r.timestamp)
+		leader.Returns(fetchRes)
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		KafkaVersion:  "0.11.0.0",
+		TimestampLag:  config.TimestampLagConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	o := events[0]["offset"].(common.MapStr)
+	assert.Equal(t, int64(4500), o["lag_ms"])
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsTimestampLagKafkaVersion(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 1, 1)
+
+	coordinator.Returns(apiVersionsResponse(map[int16]int16{apiKeyOffsetFetch: 1}))
+	offsetFetchRes := &sarama.OffsetFetchResponse{Version: 1}
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 90})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	// The broker is newer than kafka_version, messages are fetched with
+	// version 2.
+	leader.Returns(apiVersionsResponse(map[int16]int16{apiKeyListOffsets: 1, apiKeyFetch: 4}))
+	for _, offset := range []int64{101, 0} {
+		offsetRes := new(sarama.OffsetResponse)
+		offsetRes.AddTopicPartition("test-topic", 0, offset)
+		leader.Returns(offsetRes)
+	}
+
+	committedAt := time.Unix(1000, 0)
+	for _, r := range []struct {
+		offset    int64
+		timestamp time.Time
+	}{
+		{90, committedAt},
+		{100, committedAt.Add(4500 * time.Millisecond)},
+	} {
+		fetchRes := &sarama.FetchResponse{Version: 2}
+		fetchRes.AddMessageWithTimestamp("test-topic", 0, nil, sarama.StringEncoder("value"), r.offset, r.timestamp, 1)
+		leader.Returns(fetchRes)
+	}
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		KafkaVersion:  "0.10.0.0",
+		TimestampLag:  config.TimestampLagConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := client.GetOffsetEvents()
+
+	o := events[0]["offset"].(common.MapStr)
+	assert.Equal(t, int64(4500), o["lag_ms"])
+
+	for _, rr := range leader.History() {
+		if request, ok := rr.Request.(*sarama.FetchRequest); ok {
+			assert.Equal(t, int16(2), request.Version)
+		}
+	}
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
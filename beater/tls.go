@@ -0,0 +1,54 @@
+package beater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+const (
+	verificationModeFull = "full"
+	verificationModeNone = "none"
+)
+
+func newTLSConfig(conf *config.SSLConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: conf.ServerName}
+
+	switch conf.VerificationMode {
+	case "", verificationModeFull:
+	case verificationModeNone:
+		tlsConfig.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("Invalid ssl.verification_mode %q", conf.VerificationMode)
+	}
+
+	if len(conf.CertificateAuthorities) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, file := range conf.CertificateAuthorities {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificate found in %s", file)
+			}
+		}
+	}
+
+	if (conf.Certificate == "") != (conf.Key == "") {
+		return nil, errors.New("ssl.certificate and ssl.key must be set together")
+	}
+	if conf.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Certificate, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
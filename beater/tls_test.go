@@ -0,0 +1,179 @@
+package beater
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+type testCertificates struct {
+	dir        string
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverCert tls.Certificate
+	pool       *x509.CertPool
+}
+
+// generateTestCertificates creates a CA and a certificate for 127.0.0.1
+// signed by it, used by the broker and the client alike.
+func generateTestCertificates(t *testing.T) *testCertificates {
+	dir, err := ioutil.TempDir("", "kafkabeat-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafkabeat test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kafka"},
+		DNSNames:     []string{"kafka.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := &testCertificates{
+		dir:      dir,
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+		pool:     x509.NewCertPool(),
+	}
+	certs.pool.AddCert(ca)
+
+	writePEM(t, certs.caFile, "CERTIFICATE", caDER)
+	writePEM(t, certs.certFile, "CERTIFICATE", certDER)
+	writePEM(t, certs.keyFile, "EC PRIVATE KEY", keyDER)
+
+	certs.serverCert, err = tls.LoadX509KeyPair(certs.certFile, certs.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certs := generateTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+
+	assert := assert.New(t)
+
+	tlsConfig, err := newTLSConfig(&config.SSLConfig{
+		CertificateAuthorities: []string{certs.caFile},
+		Certificate:            certs.certFile,
+		Key:                    certs.keyFile,
+		ServerName:             "kafka.test",
+	})
+	assert.NoError(err)
+	assert.Len(tlsConfig.Certificates, 1)
+	assert.Equal("kafka.test", tlsConfig.ServerName)
+	assert.False(tlsConfig.InsecureSkipVerify)
+
+	tlsConfig, err = newTLSConfig(&config.SSLConfig{VerificationMode: "none"})
+	assert.NoError(err)
+	assert.True(tlsConfig.InsecureSkipVerify)
+
+	_, err = newTLSConfig(&config.SSLConfig{VerificationMode: "strict"})
+	assert.Error(err)
+
+	_, err = newTLSConfig(&config.SSLConfig{Certificate: certs.certFile})
+	assert.Error(err)
+
+	_, err = newTLSConfig(&config.SSLConfig{CertificateAuthorities: []string{certs.keyFile}})
+	assert.Error(err)
+}
+
+func TestNewKafkaClientTLS(t *testing.T) {
+	certs := generateTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener := tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{certs.serverCert},
+		ClientCAs:    certs.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	seedBroker := sarama.NewMockBrokerListener(t, 1, tlsListener)
+	seedBroker.Returns(new(sarama.MetadataResponse))
+
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts:         []string{seedBroker.Addr()},
+		ConsumerGroup: "test",
+		Topics:        []string{"test-topic"},
+		SSL: config.SSLConfig{
+			Enabled:                true,
+			CertificateAuthorities: []string{certs.caFile},
+			Certificate:            certs.certFile,
+			Key:                    certs.keyFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedBroker.Close()
+	safeClose(t, client)
+}
@@ -0,0 +1,96 @@
+package beater
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type topicPattern struct {
+	name   string
+	glob   bool
+	regexp *regexp.Regexp
+}
+
+func parseTopicPatterns(entries []string) ([]*topicPattern, error) {
+	var patterns []*topicPattern
+	for _, entry := range entries {
+		p := &topicPattern{name: entry}
+
+		switch {
+		case len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+			re, err := regexp.Compile(entry[1 : len(entry)-1])
+			if err != nil {
+				return nil, err
+			}
+			p.regexp = re
+		case strings.ContainsAny(entry, "*?["):
+			if _, err := path.Match(entry, ""); err != nil {
+				return nil, err
+			}
+			p.glob = true
+		}
+
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p *topicPattern) isLiteral() bool {
+	return p.regexp == nil && !p.glob
+}
+
+func (p *topicPattern) match(topic string) bool {
+	switch {
+	case p.regexp != nil:
+		return p.regexp.MatchString(topic)
+	case p.glob:
+		ok, _ := path.Match(p.name, topic)
+		return ok
+	default:
+		return p.name == topic
+	}
+}
+
+func hasTopicWildcards(patterns []*topicPattern) bool {
+	for _, p := range patterns {
+		if !p.isLiteral() {
+			return true
+		}
+	}
+	return false
+}
+
+func isInternalTopic(topic string) bool {
+	return strings.HasPrefix(topic, "__")
+}
+
+// resolveTopics expands the patterns against the topics known to the cluster.
+// Literal names are kept as they are, so that missing topics are still reported.
+func resolveTopics(patterns []*topicPattern, clusterTopics []string, includeInternal bool) []string {
+	found := make(map[string]bool)
+	for _, p := range patterns {
+		if p.isLiteral() {
+			found[p.name] = true
+			continue
+		}
+
+		for _, topic := range clusterTopics {
+			if !includeInternal && isInternalTopic(topic) {
+				continue
+			}
+			if p.match(topic) {
+				found[topic] = true
+			}
+		}
+	}
+
+	topics := make([]string, 0, len(found))
+	for topic := range found {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
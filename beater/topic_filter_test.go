@@ -0,0 +1,48 @@
+package beater
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveTopics(t *testing.T) {
+	patterns, err := parseTopicPatterns([]string{"orders-*", "/^payments\\.v[0-9]+$/", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterTopics := []string{
+		"__consumer_offsets",
+		"orders-eu",
+		"orders-us",
+		"payments.v1",
+		"payments.v1.dlq",
+		"users",
+	}
+
+	assert.Equal(t,
+		[]string{"missing", "orders-eu", "orders-us", "payments.v1"},
+		resolveTopics(patterns, clusterTopics, false))
+}
+
+func TestResolveTopicsInternal(t *testing.T) {
+	patterns, err := parseTopicPatterns([]string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterTopics := []string{"__consumer_offsets", "users"}
+
+	assert := assert.New(t)
+	assert.Equal([]string{"users"}, resolveTopics(patterns, clusterTopics, false))
+	assert.Equal(clusterTopics, resolveTopics(patterns, clusterTopics, true))
+}
+
+func TestParseTopicPatternsInvalid(t *testing.T) {
+	_, err := parseTopicPatterns([]string{"/(/"})
+	assert.Error(t, err)
+
+	_, err = parseTopicPatterns([]string{"orders-["})
+	assert.Error(t, err)
+}
@@ -0,0 +1,78 @@
+package beater
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+type zookeeperConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	Close()
+}
+
+// ZookeeperClient reads the offsets committed by legacy consumers, which are
+// stored under /consumers/<group>/offsets/<topic>/<partition>.
+type ZookeeperClient struct {
+	conn   zookeeperConn
+	chroot string
+}
+
+// zookeeperLogger passes the connection messages of the zookeeper client,
+// which go to the standard logger by default, to logp.
+type zookeeperLogger struct{}
+
+func (zookeeperLogger) Printf(format string, v ...interface{}) {
+	logp.Info("zookeeper: "+format, v...)
+}
+
+func NewZookeeperClient(hosts []string, timeout time.Duration, chroot string) (*ZookeeperClient, error) {
+	conn, _, err := zk.Connect(hosts, timeout, zk.WithLogger(zookeeperLogger{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZookeeperClient{conn: conn, chroot: chroot}, nil
+}
+
+func (c *ZookeeperClient) Close() {
+	c.conn.Close()
+}
+
+func (c *ZookeeperClient) offsetPath(group, topic string, partition int32) string {
+	return path.Join("/", c.chroot, "consumers", group, "offsets", topic, strconv.Itoa(int(partition)))
+}
+
+func (c *ZookeeperClient) fetchConsumerOffsets(group string, tp topicPartitions) (partitionOffsets, error) {
+	offsets := make(partitionOffsets)
+
+	for topic, partitions := range tp {
+		offsets[topic] = make(partitionOffset)
+
+		for _, partition := range partitions {
+			p := c.offsetPath(group, topic, partition)
+
+			data, _, err := c.conn.Get(p)
+			if err == zk.ErrNoNode {
+				offsets[topic][partition] = -1
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid offset in %s: %v", p, err)
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+
+	return offsets, nil
+}
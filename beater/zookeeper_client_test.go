@@ -0,0 +1,208 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/daichirata/kafkabeat/config"
+)
+
+type mockZookeeperConn struct {
+	nodes  map[string]string
+	closed bool
+}
+
+func (c *mockZookeeperConn) Get(path string) ([]byte, *zk.Stat, error) {
+	data, ok := c.nodes[path]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(data), &zk.Stat{}, nil
+}
+
+func (c *mockZookeeperConn) Close() {
+	c.closed = true
+}
+
+func TestZookeeperFetchConsumerOffsets(t *testing.T) {
+	conn := &mockZookeeperConn{nodes: map[string]string{
+		"/kafka/consumers/test/offsets/test-topic/0": "110",
+		"/kafka/consumers/test/offsets/test-topic/1": "220\n",
+	}}
+	client := &ZookeeperClient{conn: conn, chroot: "/kafka"}
+
+	offsets, err := client.fetchConsumerOffsets("test", topicPartitions{"test-topic": {0, 1, 2}})
+
+	assert := assert.New(t)
+	assert.NoError(err)
+	assert.Equal(partitionOffsets{"test-topic": {0: 110, 1: 220, 2: -1}}, offsets)
+
+	client.Close()
+	assert.True(conn.closed)
+}
+
+func TestZookeeperFetchConsumerOffsetsInvalid(t *testing.T) {
+	conn := &mockZookeeperConn{nodes: map[string]string{
+		"/consumers/test/offsets/test-topic/0": "abc",
+	}}
+	client := &ZookeeperClient{conn: conn}
+
+	_, err := client.fetchConsumerOffsets("test", topicPartitions{"test-topic": {0}})
+	assert.Error(t, err)
+}
+
+func TestMaxOffsets(t *testing.T) {
+	a := partitionOffsets{"test-topic": {0: 110, 1: -1}}
+	b := partitionOffsets{"test-topic": {0: 100, 1: 220}, "other": {0: 5}}
+
+	assert.Equal(t, partitionOffsets{
+		"test-topic": {0: 110, 1: 220},
+		"other":      {0: 5},
+	}, maxOffsets(a, b))
+}
+
+func TestPartitionErrorsMissingFrom(t *testing.T) {
+	errs := partitionErrors{
+		{"test-topic", 0}: sarama.ErrNotCoordinatorForConsumer,
+		{"test-topic", 1}: sarama.ErrNotCoordinatorForConsumer,
+		{"test-topic", 2}: sarama.ErrNotCoordinatorForConsumer,
+	}
+	zo := partitionOffsets{"test-topic": {0: 110, 1: -1}}
+
+	assert.Equal(t, partitionErrors{
+		{"test-topic", 1}: sarama.ErrNotCoordinatorForConsumer,
+		{"test-topic", 2}: sarama.ErrNotCoordinatorForConsumer,
+	}, errs.missingFrom(zo))
+}
+
+func TestNewZookeeperClient(t *testing.T) {
+	// Connecting happens in the background, nothing needs to listen.
+	client, err := NewZookeeperClient([]string{"127.0.0.1:1"}, time.Second, "/kafka")
+	assert.NoError(t, err)
+	assert.Equal(t, "/kafka/consumers/test/offsets/test-topic/0", client.offsetPath("test", "test-topic", 0))
+	client.Close()
+
+	_, err = NewZookeeperClient(nil, time.Second, "")
+	assert.Error(t, err)
+}
+
+// newZookeeperTestClient creates a client reading the offsets of group test
+// from storage, with zookeeper replaced by nodes.
+func newZookeeperTestClient(t *testing.T, seedBroker *sarama.MockBroker, storage string, nodes map[string]string) *KafkaClient {
+	client, err := NewKafkaClient(&config.KafkabeatConfig{
+		Hosts: []string{seedBroker.Addr()},
+		ConsumerGroups: []config.ConsumerGroupConfig{
+			{Name: "test", Topics: []string{"test-topic"}, OffsetStorage: storage},
+		},
+		Zookeeper: config.ZookeeperConfig{Hosts: []string{"127.0.0.1:1"}, Chroot: "/kafka"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.zookeeper.Close()
+	client.zookeeper.conn = &mockZookeeperConn{nodes: nodes}
+	return client
+}
+
+func TestGetOffsetEventsZookeeper(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	leader := sarama.NewMockBroker(t, 3)
+
+	// Neither the coordinator nor the group are asked for.
+	seedBroker.Returns(metadataResponse(leader, 0, 2))
+	for _, offsets := range [][]int64{{111, 222}, {0, 21}} {
+		offsetRes := new(sarama.OffsetResponse)
+		offsetRes.AddTopicPartition("test-topic", 0, offsets[0])
+		offsetRes.AddTopicPartition("test-topic", 1, offsets[1])
+		leader.Returns(offsetRes)
+	}
+
+	client := newZookeeperTestClient(t, seedBroker, "zookeeper", map[string]string{
+		"/kafka/consumers/test/offsets/test-topic/0": "100",
+	})
+	// Commits in zookeeper never show up in __consumer_offsets.
+	client.offsetsTopic = &offsetsTopicCollector{
+		offsets: make(map[groupPartitionKey]*committedOffset),
+		groups:  make(map[string]*loggedGroup),
+		pending: make(map[int32]*pendingPartition),
+	}
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal(int32(0), o1["partition"].(int32))
+	assert.Equal(true, o1["committed"].(bool))
+	assert.Equal(int64(100), o1["consumer_offset"].(int64))
+	assert.Equal(int64(10), o1["lag"].(int64))
+	assert.NotContains(o1, "member_id")
+	assert.Contains(o1, "last_commit_timestamp")
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal(int32(1), o2["partition"].(int32))
+	assert.Equal(false, o2["committed"].(bool))
+
+	client.offsetsTopic = nil
+	seedBroker.Close()
+	leader.Close()
+	safeClose(t, client)
+}
+
+func TestGetOffsetEventsZookeeperAndKafka(t *testing.T) {
+	seedBroker := sarama.NewMockBroker(t, 1)
+	coordinator := sarama.NewMockBroker(t, 2)
+	leader := sarama.NewMockBroker(t, 3)
+
+	initSeedBroker(seedBroker, coordinator, leader, 0, 3)
+
+	offsetFetchRes := new(sarama.OffsetFetchResponse)
+	offsetFetchRes.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrNoError, Offset: 110})
+	offsetFetchRes.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrUnknownTopicOrPartition})
+	offsetFetchRes.AddBlock("test-topic", 2, &sarama.OffsetFetchResponseBlock{Err: sarama.ErrUnknownTopicOrPartition})
+	coordinator.Returns(offsetFetchRes)
+	coordinator.Returns(describeGroupsResponse("test", nil))
+
+	for _, offsets := range [][]int64{{111, 222, 333}, {0, 0, 0}} {
+		offsetRes := new(sarama.OffsetResponse)
+		for partition, offset := range offsets {
+			offsetRes.AddTopicPartition("test-topic", int32(partition), offset)
+		}
+		leader.Returns(offsetRes)
+	}
+
+	// Partition 0 is newer in kafka, partition 1 only in zookeeper and
+	// partition 2 in neither, so its kafka error is reported.
+	client := newZookeeperTestClient(t, seedBroker, "both", map[string]string{
+		"/kafka/consumers/test/offsets/test-topic/0": "100",
+		"/kafka/consumers/test/offsets/test-topic/1": "220",
+	})
+
+	events := client.GetOffsetEvents()
+
+	assert := assert.New(t)
+
+	o1 := events[0]["offset"].(common.MapStr)
+	assert.Equal(int32(0), o1["partition"].(int32))
+	assert.Equal(int64(110), o1["consumer_offset"].(int64))
+
+	o2 := events[1]["offset"].(common.MapStr)
+	assert.Equal(int32(1), o2["partition"].(int32))
+	assert.NotContains(o2, "error")
+	assert.Equal(int64(220), o2["consumer_offset"].(int64))
+
+	o3 := events[2]["offset"].(common.MapStr)
+	assert.Equal(int32(2), o3["partition"].(int32))
+	assert.Equal(int16(sarama.ErrUnknownTopicOrPartition), o3["error"].(common.MapStr)["code"])
+
+	seedBroker.Close()
+	coordinator.Close()
+	leader.Close()
+	safeClose(t, client)
+}
@@ -8,11 +8,88 @@ type Config struct {
 }
 
 type KafkabeatConfig struct {
-	Period        string
-	ConsumerGroup string `config:"consumer_group"`
+	Period                string
+	ConsumerGroup         string                `config:"consumer_group"`
+	ConsumerGroups        []ConsumerGroupConfig `config:"consumer_groups"`
+	GroupDiscovery        GroupDiscoveryConfig  `config:"group_discovery"`
+	TimestampLag          TimestampLagConfig    `config:"timestamp_lag"`
+	Topics                []string
+	IncludeInternalTopics bool   `config:"include_internal_topics"`
+	CommittedTopics       bool   `config:"committed_topics"`
+	OffsetHistory         string `config:"offset_history"`
+	LagWindowSize         int    `config:"lag_window_size"`
+	ConsumeOffsetsTopic   bool   `config:"consume_offsets_topic"`
+	UncommittedLag        string `config:"uncommitted_lag"`
+	LagEvents             string `config:"lag_events"`
+	LagThreshold          int64  `config:"lag_threshold"`
+	PartitionEvents       bool   `config:"partition_events"`
+	BrokerConcurrency     int    `config:"broker_concurrency"`
+	BrokerTimeout         string `config:"broker_timeout"`
+	Retry                 RetryConfig
+	KafkaVersion          string `config:"kafka_version"`
+	IsolationLevel        string `config:"isolation_level"`
+	ClientID              string `config:"client_id"`
+	DialTimeout           string `config:"dial_timeout"`
+	ReadTimeout           string `config:"read_timeout"`
+	Metadata              MetadataConfig
+	Hosts                 []string
+	SSL                   SSLConfig
+	SASL                  SASLConfig
+	Zookeeper             ZookeeperConfig
+	Jolokia               JolokiaConfig
+}
+
+type ConsumerGroupConfig struct {
+	Name          string
 	Topics        []string
-	Hosts         []string
-	Jolokia       JolokiaConfig
+	OffsetStorage string `config:"offset_storage"`
+}
+
+type ZookeeperConfig struct {
+	Hosts   []string
+	Timeout string
+	Chroot  string
+}
+
+type SSLConfig struct {
+	Enabled                bool
+	CertificateAuthorities []string `config:"certificate_authorities"`
+	Certificate            string
+	Key                    string
+	VerificationMode       string `config:"verification_mode"`
+	ServerName             string `config:"server_name"`
+}
+
+type SASLConfig struct {
+	Mechanism    string
+	Username     string
+	Password     string
+	PasswordFile string `config:"password_file"`
+	PasswordEnv  string `config:"password_env"`
+	TokenURL     string `config:"token_url"`
+	Scopes       []string
+}
+
+type TimestampLagConfig struct {
+	Enabled    bool
+	MaxFetches int `config:"max_fetches"`
+}
+
+type MetadataConfig struct {
+	RefreshFrequency string `config:"refresh_frequency"`
+	Full             *bool
+}
+
+type RetryConfig struct {
+	Max     int
+	Backoff string
+}
+
+type GroupDiscoveryConfig struct {
+	Enabled         bool
+	Include         []string
+	Exclude         []string
+	RefreshInterval string `config:"refresh_interval"`
 }
 
 type JolokiaConfig struct {